@@ -0,0 +1,242 @@
+package dhcp
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+)
+
+// Allocator types for Subnet.Allocator.
+const (
+	AllocatorBitmap = "bitmap"
+	AllocatorWalk   = "walk"
+)
+
+// Allocator keeps track of used addresses in the subnet range. Addresses out
+// of the range are ignored.
+type Allocator interface {
+	// Allocate takes a never used or freed address, or else the address which
+	// expired first before now. It returns false if every address is in use.
+	Allocate(now time.Time) (IPv4, bool)
+	// Use marks ip used until expiry. Zero expiry holds the address until Free.
+	Use(ip IPv4, expiry time.Time)
+	// Free returns ip to the pool.
+	Free(ip IPv4)
+}
+
+func newAllocator(kind string, from IPv4, to IPv4) (Allocator, error) {
+	switch kind {
+	case "", AllocatorBitmap:
+		return newBitmapAllocator(from, to), nil
+	case AllocatorWalk:
+		return newWalkAllocator(from, to), nil
+	default:
+		return nil, fmt.Errorf("unknown allocator %q", kind)
+	}
+}
+
+// bitmapAllocator allocates in O(1): never used addresses are taken in order,
+// freed ones from a queue, and expiring ones from a min-heap.
+type bitmapAllocator struct {
+	from IPv4
+	size uint64
+	used []uint64
+	// next is the offset of the first address which has never been allocated
+	next uint64
+	// free may contain stale offsets, which are used again; they are skipped
+	free     []uint64
+	expiries expiryHeap
+	items    map[uint64]*expiryItem
+}
+
+func newBitmapAllocator(from IPv4, to IPv4) *bitmapAllocator {
+	size := uint64(to-from) + 1
+	return &bitmapAllocator{
+		from:  from,
+		size:  size,
+		used:  make([]uint64, (size+63)/64),
+		items: make(map[uint64]*expiryItem),
+	}
+}
+
+func (a *bitmapAllocator) offset(ip IPv4) (uint64, bool) {
+	if ip < a.from || uint64(ip-a.from) >= a.size {
+		return 0, false
+	}
+	return uint64(ip - a.from), true
+}
+
+func (a *bitmapAllocator) isUsed(off uint64) bool {
+	return a.used[off/64]&(1<<(off%64)) != 0
+}
+
+func (a *bitmapAllocator) setUsed(off uint64, used bool) {
+	if used {
+		a.used[off/64] |= 1 << (off % 64)
+	} else {
+		a.used[off/64] &^= 1 << (off % 64)
+	}
+}
+
+func (a *bitmapAllocator) Allocate(now time.Time) (IPv4, bool) {
+	for a.next < a.size {
+		off := a.next
+		a.next++
+		if !a.isUsed(off) {
+			a.setUsed(off, true)
+			return a.from + IPv4(off), true
+		}
+	}
+	for len(a.free) > 0 {
+		off := a.free[0]
+		a.free = a.free[1:]
+		if !a.isUsed(off) {
+			a.setUsed(off, true)
+			return a.from + IPv4(off), true
+		}
+	}
+	if len(a.expiries) > 0 && a.expiries[0].expiry.Before(now) {
+		item := heap.Pop(&a.expiries).(*expiryItem)
+		delete(a.items, item.off)
+		return a.from + IPv4(item.off), true
+	}
+	return 0, false
+}
+
+func (a *bitmapAllocator) Use(ip IPv4, expiry time.Time) {
+	off, ok := a.offset(ip)
+	if !ok {
+		return
+	}
+	a.setUsed(off, true)
+	item, ok := a.items[off]
+	switch {
+	case expiry.IsZero() && ok:
+		heap.Remove(&a.expiries, item.index)
+		delete(a.items, off)
+	case expiry.IsZero():
+	case ok:
+		item.expiry = expiry
+		heap.Fix(&a.expiries, item.index)
+	default:
+		item = &expiryItem{off: off, expiry: expiry}
+		heap.Push(&a.expiries, item)
+		a.items[off] = item
+	}
+}
+
+func (a *bitmapAllocator) Free(ip IPv4) {
+	off, ok := a.offset(ip)
+	if !ok || !a.isUsed(off) {
+		return
+	}
+	a.setUsed(off, false)
+	if item, ok := a.items[off]; ok {
+		heap.Remove(&a.expiries, item.index)
+		delete(a.items, off)
+	}
+	if off < a.next {
+		a.free = append(a.free, off)
+	}
+}
+
+type expiryItem struct {
+	off    uint64
+	expiry time.Time
+	index  int
+}
+
+// expiryHeap is a min-heap of used addresses by expiry.
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// walkAllocator walks the range round robin looking for a free address, or
+// the address which expired first. It takes O(range) per allocation once
+// the range fills up.
+type walkAllocator struct {
+	from     IPv4
+	to       IPv4
+	current  IPv4
+	expiries map[IPv4]time.Time
+}
+
+func newWalkAllocator(from IPv4, to IPv4) *walkAllocator {
+	return &walkAllocator{
+		from:     from,
+		to:       to,
+		expiries: make(map[IPv4]time.Time),
+	}
+}
+
+func (a *walkAllocator) increment() {
+	if a.current == a.to {
+		a.current = a.from
+		return
+	}
+	a.current.Inc()
+}
+
+func (a *walkAllocator) Allocate(now time.Time) (IPv4, bool) {
+	var (
+		oldest       IPv4
+		oldestExpiry time.Time
+		found        bool
+	)
+	if a.current == 0 {
+		a.current = a.from
+	} else {
+		a.increment()
+	}
+	first := a.current
+	for {
+		expiry, used := a.expiries[a.current]
+		if !used {
+			a.expiries[a.current] = time.Time{}
+			return a.current, true
+		}
+		if !expiry.IsZero() && expiry.Before(now) && (!found || expiry.Before(oldestExpiry)) {
+			oldest, oldestExpiry, found = a.current, expiry, true
+		}
+		a.increment()
+		if a.current == first {
+			if found {
+				a.expiries[oldest] = time.Time{}
+			}
+			return oldest, found
+		}
+	}
+}
+
+func (a *walkAllocator) Use(ip IPv4, expiry time.Time) {
+	if ip < a.from || ip > a.to {
+		return
+	}
+	a.expiries[ip] = expiry
+}
+
+func (a *walkAllocator) Free(ip IPv4) {
+	delete(a.expiries, ip)
+}
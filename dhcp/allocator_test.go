@@ -0,0 +1,216 @@
+package dhcp
+
+import (
+	"testing"
+	"time"
+)
+
+func testAllocator(t *testing.T, kind string) {
+	from, _ := ParseIPv4("10.1.1.1")
+	to, _ := ParseIPv4("10.1.1.3")
+	a, err := newAllocator(kind, from, to)
+	assertNoError(t, err)
+	now := time.Now()
+
+	a.Use(from+1, time.Time{})
+	ip, ok := a.Allocate(now)
+	assertTrue(t, ok)
+	assertEqual(t, "10.1.1.1", ip.String())
+	a.Use(ip, now.Add(time.Minute))
+	ip, ok = a.Allocate(now)
+	assertTrue(t, ok)
+	assertEqual(t, "10.1.1.3", ip.String())
+	a.Use(ip, now.Add(time.Second))
+	_, ok = a.Allocate(now)
+	assertTrue(t, !ok)
+
+	// freed address is taken before the expired ones
+	a.Free(from + 1)
+	ip, ok = a.Allocate(now.Add(time.Hour))
+	assertTrue(t, ok)
+	assertEqual(t, "10.1.1.2", ip.String())
+	a.Use(ip, time.Time{})
+
+	// the address which expired first
+	ip, ok = a.Allocate(now.Add(time.Hour))
+	assertTrue(t, ok)
+	assertEqual(t, "10.1.1.3", ip.String())
+	a.Use(ip, now.Add(time.Hour*2))
+	ip, ok = a.Allocate(now.Add(time.Hour))
+	assertTrue(t, ok)
+	assertEqual(t, "10.1.1.1", ip.String())
+	a.Use(ip, now.Add(time.Hour*2))
+	_, ok = a.Allocate(now.Add(time.Hour))
+	assertTrue(t, !ok)
+
+	// out of range
+	a.Use(to+1, time.Time{})
+	a.Free(from - 1)
+	_, ok = a.Allocate(now.Add(time.Hour))
+	assertTrue(t, !ok)
+}
+
+func TestAllocator_Bitmap(t *testing.T) {
+	testAllocator(t, AllocatorBitmap)
+}
+
+func TestAllocator_Walk(t *testing.T) {
+	testAllocator(t, AllocatorWalk)
+}
+
+func TestAllocator_Unknown(t *testing.T) {
+	_, err := newAllocator("random", 1, 2)
+	assertTrue(t, err != nil)
+	_, err = InitializeSubnet(&Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.3", Allocator: "random"})
+	assertTrue(t, err != nil)
+}
+
+// benchmarkAllocator measures allocation in a full range, where the only
+// free address is the one released by the previous iteration.
+func benchmarkAllocator(b *testing.B, kind string, from string, to string) {
+	ipFrom, _ := ParseIPv4(from)
+	ipTo, _ := ParseIPv4(to)
+	a, err := newAllocator(kind, ipFrom, ipTo)
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now()
+	expiry := now.Add(time.Hour)
+	for {
+		ip, ok := a.Allocate(now)
+		if !ok {
+			break
+		}
+		a.Use(ip, expiry)
+	}
+	a.Free(ipFrom + (ipTo-ipFrom)/2)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip, ok := a.Allocate(now)
+		if !ok {
+			b.Fatal("range is exhausted")
+		}
+		a.Free(ip)
+	}
+}
+
+func BenchmarkAllocator_Bitmap24(b *testing.B) {
+	benchmarkAllocator(b, AllocatorBitmap, "10.0.0.1", "10.0.0.254")
+}
+
+func BenchmarkAllocator_Walk24(b *testing.B) {
+	benchmarkAllocator(b, AllocatorWalk, "10.0.0.1", "10.0.0.254")
+}
+
+func BenchmarkAllocator_Bitmap16(b *testing.B) {
+	benchmarkAllocator(b, AllocatorBitmap, "10.0.0.1", "10.0.255.254")
+}
+
+func BenchmarkAllocator_Walk16(b *testing.B) {
+	benchmarkAllocator(b, AllocatorWalk, "10.0.0.1", "10.0.255.254")
+}
+
+func BenchmarkAllocator_Bitmap12(b *testing.B) {
+	benchmarkAllocator(b, AllocatorBitmap, "10.0.0.1", "10.15.255.254")
+}
+
+func BenchmarkAllocator_Walk12(b *testing.B) {
+	benchmarkAllocator(b, AllocatorWalk, "10.0.0.1", "10.15.255.254")
+}
+
+// legacyWalk is GetLeaseForMAC as it was before Allocator: a walk over the
+// range from the last allocated address, stringifying every address to look
+// it up in the lease cache. It is the baseline of the allocator benchmarks.
+type legacyWalk struct {
+	iPFrom     IPv4
+	iPTo       IPv4
+	currentIP  IPv4
+	leaseTime  int
+	leaseCache map[string]*Lease
+}
+
+func (s *legacyWalk) incrementCurrentIP() {
+	s.currentIP.Inc()
+	if s.currentIP > s.iPTo {
+		s.currentIP = s.iPFrom
+	}
+}
+
+func (s *legacyWalk) getLeaseForMAC(mac string) *Lease {
+	var (
+		lease       *Lease
+		oldestLease *Lease
+		ok          bool
+	)
+	lease, ok = s.leaseCache[mac]
+	if ok {
+		return lease
+	}
+	if s.currentIP == 0 {
+		s.currentIP = s.iPFrom
+	} else {
+		s.incrementCurrentIP()
+	}
+	expiredTime := time.Now().Add(-time.Second * time.Duration(s.leaseTime))
+	firstIp := s.currentIP
+	for {
+		lease, ok = s.leaseCache[s.currentIP.String()]
+		if !ok {
+			lease = &Lease{
+				IP:         s.currentIP.String(),
+				LastUpdate: time.Now(),
+				LeaseTime:  s.leaseTime,
+			}
+			s.leaseCache[lease.IP] = lease
+			s.leaseCache[mac] = lease
+			return lease
+		}
+		if lease.LastUpdate.Before(expiredTime) {
+			if oldestLease == nil || oldestLease.LastUpdate.After(lease.LastUpdate) {
+				oldestLease = lease
+			}
+		}
+		s.incrementCurrentIP()
+		if firstIp == s.currentIP {
+			return oldestLease
+		}
+	}
+}
+
+// benchmarkLegacyWalk measures the same full range as benchmarkAllocator
+// with the walk of the lease cache.
+func benchmarkLegacyWalk(b *testing.B, from string, to string) {
+	ipFrom, _ := ParseIPv4(from)
+	ipTo, _ := ParseIPv4(to)
+	s := &legacyWalk{iPFrom: ipFrom, iPTo: ipTo, leaseTime: defaultLeaseTime, leaseCache: make(map[string]*Lease)}
+	// leases are only looked up, so all addresses may share one
+	used := &Lease{LastUpdate: time.Now()}
+	for ip := ipFrom; ip <= ipTo; ip++ {
+		s.leaseCache[ip.String()] = used
+	}
+	free := ipFrom + (ipTo-ipFrom)/2
+	delete(s.leaseCache, free.String())
+	s.currentIP = free
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lease := s.getLeaseForMAC("02:00:00:00:00:01")
+		if lease == nil {
+			b.Fatal("range is exhausted")
+		}
+		// release
+		delete(s.leaseCache, lease.IP)
+		delete(s.leaseCache, "02:00:00:00:00:01")
+	}
+}
+
+func BenchmarkAllocator_Legacy24(b *testing.B) {
+	benchmarkLegacyWalk(b, "10.0.0.1", "10.0.0.254")
+}
+
+func BenchmarkAllocator_Legacy16(b *testing.B) {
+	benchmarkLegacyWalk(b, "10.0.0.1", "10.0.255.254")
+}
+
+func BenchmarkAllocator_Legacy12(b *testing.B) {
+	benchmarkLegacyWalk(b, "10.0.0.1", "10.15.255.254")
+}
@@ -0,0 +1,1087 @@
+package dhcp
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// FailoverState is the state of a failover server (draft-ietf-dhc-failover-12
+// section 9). Only the states needed to recover from a failed peer are used.
+type FailoverState uint8
+
+const (
+	FailoverStartup                   FailoverState = 1
+	FailoverNormal                    FailoverState = 2
+	FailoverCommunicationsInterrupted FailoverState = 3
+	FailoverPartnerDown               FailoverState = 4
+	FailoverRecover                   FailoverState = 6
+	FailoverRecoverDone               FailoverState = 9
+)
+
+func (st FailoverState) String() string {
+	switch st {
+	case FailoverStartup:
+		return "STARTUP"
+	case FailoverNormal:
+		return "NORMAL"
+	case FailoverCommunicationsInterrupted:
+		return "COMMUNICATIONS-INTERRUPTED"
+	case FailoverPartnerDown:
+		return "PARTNER-DOWN"
+	case FailoverRecover:
+		return "RECOVER"
+	case FailoverRecoverDone:
+		return "RECOVER-DONE"
+	}
+	return fmt.Sprintf("state %d", uint8(st))
+}
+
+const (
+	defaultFailoverMCLT         = 3600
+	defaultFailoverReceiveTimer = 60
+	// failoverRetry is the delay before the primary server reconnects.
+	failoverRetry = time.Second
+	// htypeEthernet is the hardware type in the client-hardware-address option.
+	htypeEthernet = 1
+	// failoverMaxUnacked is the number of BNDUPD the server accepts from the
+	// peer before acknowledging them. Updates are handled one by one in the
+	// order they arrive, so the limit only tells the peer how far it may run ahead.
+	failoverMaxUnacked = 100
+)
+
+// errOutdatedBinding is returned for a binding from the peer which is older
+// than the cached lease of another client.
+var errOutdatedBinding = errors.New("outdated binding")
+
+// FailoverConfig configures the failover relationship with a peer server.
+type FailoverConfig struct {
+	// Name is the relationship name, which must be the same at both servers.
+	Name string `json:"name"`
+	// Role is LoadBalancePrimary or LoadBalanceSecondary.
+	Role string `json:"role"`
+	// Laddr is the TCP address the secondary server accepts the primary one at.
+	Laddr string `json:"laddr,omitempty"`
+	// Peer is the TCP address of the secondary server the primary one connects to.
+	Peer string `json:"peer,omitempty"`
+	// Split is the number of hash buckets answered by the primary server (RFC 3074).
+	// The secondary server uses the buckets sent by the primary one.
+	Split int `json:"split"`
+	// MCLT is the maximum client lead time in seconds. Leases expire at most
+	// MCLT after the expiry the peer acknowledged, and a server in
+	// PARTNER-DOWN state waits MCLT before it allocates addresses of the peer.
+	MCLT int `json:"mclt,omitempty"`
+	// ReceiveTimer is how long (in seconds) the connection may be silent
+	// before communications are considered interrupted.
+	ReceiveTimer int `json:"receiveTimer,omitempty"`
+	// AutoPartnerDown is how long (in seconds) after communications are
+	// interrupted the peer is assumed down. Zero waits for PartnerDown.
+	AutoPartnerDown int `json:"autoPartnerDown,omitempty"`
+}
+
+// Failover keeps leases of the server in sync with a peer server over the
+// failover protocol (draft-ietf-dhc-failover-12). Both servers answer their
+// hash buckets of the clients, the secondary one allocates from the backup addresses the primary one transfers to it on
+// POOLREQ. A server answers all clients from all free addresses only in
+// PARTNER-DOWN state.
+type Failover struct {
+	config    FailoverConfig
+	server    *Server
+	secondary bool
+
+	// smu serializes state transitions together with their side effects.
+	smu sync.Mutex
+
+	mu        sync.Mutex
+	state     FailoverState
+	peerState FailoverState
+	hba       []byte
+	conn      net.Conn
+	synced    bool
+	closed    bool
+	listener  net.Listener
+	timer     *time.Timer
+	xid       uint32
+	// pending are the bindings sent to the peer and not acknowledged yet, by XID.
+	pending map[uint32]pendingBinding
+
+	// wmu serializes writes to the connection.
+	wmu sync.Mutex
+
+	poolMu sync.Mutex
+	pools  map[string]*failoverPool
+}
+
+// NewFailover attaches the failover relationship to server. Start connects
+// to the peer.
+func NewFailover(server *Server, config FailoverConfig) (*Failover, error) {
+	if config.Name == "" {
+		return nil, errors.New("failover relationship name is empty")
+	}
+	f := &Failover{
+		config:  config,
+		server:  server,
+		state:   FailoverStartup,
+		pending: make(map[uint32]pendingBinding),
+		pools:   make(map[string]*failoverPool),
+	}
+	switch config.Role {
+	case LoadBalancePrimary:
+		if config.Peer == "" {
+			return nil, errors.New("failover peer address is empty")
+		}
+	case LoadBalanceSecondary:
+		if config.Laddr == "" {
+			return nil, errors.New("failover listen address is empty")
+		}
+		f.secondary = true
+	default:
+		return nil, fmt.Errorf("unknown failover role %q", config.Role)
+	}
+	if config.Split < 0 || config.Split > loadBalanceBuckets {
+		return nil, fmt.Errorf("invalid failover split %d", config.Split)
+	}
+	if f.config.MCLT == 0 {
+		f.config.MCLT = defaultFailoverMCLT
+	}
+	if f.config.ReceiveTimer == 0 {
+		f.config.ReceiveTimer = defaultFailoverReceiveTimer
+	}
+	f.hba = make([]byte, loadBalanceBuckets/8)
+	for bucket := 0; bucket < config.Split; bucket++ {
+		f.hba[bucket/8] |= 1 << (bucket % 8)
+	}
+
+	server.mu.Lock()
+	server.failover = f
+	server.mu.Unlock()
+	for _, subnet := range server.subnetList() {
+		subnet.setPool(f.pool(subnet.Subnet))
+	}
+	return f, nil
+}
+
+func (f *Failover) receiveTimer() time.Duration {
+	return time.Second * time.Duration(f.config.ReceiveTimer)
+}
+
+// Start accepts or connects the peer in background. The server leaves
+// STARTUP state after the receive timer if the peer is not reachable.
+func (f *Failover) Start() error {
+	if f.secondary {
+		l, err := net.Listen("tcp", f.config.Laddr)
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		f.listener = l
+		f.mu.Unlock()
+		go f.accept(l)
+	} else {
+		go f.dial()
+	}
+	f.mu.Lock()
+	f.timer = time.AfterFunc(f.receiveTimer(), func() {
+		f.transition(func(st FailoverState, peer FailoverState, synced bool) FailoverState {
+			if st == FailoverStartup {
+				return FailoverCommunicationsInterrupted
+			}
+			return st
+		})
+	})
+	f.mu.Unlock()
+	log.Printf("Failover %s started as %s", f.config.Name, f.config.Role)
+	return nil
+}
+
+// Addr returns the address the secondary server accepts the peer at.
+func (f *Failover) Addr() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listener == nil {
+		return nil
+	}
+	return f.listener.Addr()
+}
+
+// Close disconnects the peer and stops accepting or connecting it.
+func (f *Failover) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.listener != nil {
+		_ = f.listener.Close()
+	}
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+}
+
+func (f *Failover) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *Failover) State() FailoverState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *Failover) PeerState() FailoverState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.peerState
+}
+
+// PartnerDown is the operator's assertion that the peer is down while
+// communications are interrupted. The server answers all clients from all
+// free addresses afterwards.
+func (f *Failover) PartnerDown() error {
+	var err error
+	f.transition(func(st FailoverState, peer FailoverState, synced bool) FailoverState {
+		if st != FailoverCommunicationsInterrupted && st != FailoverPartnerDown {
+			err = fmt.Errorf("failover %s is in %s state", f.config.Name, st)
+			return st
+		}
+		return FailoverPartnerDown
+	})
+	return err
+}
+
+// transition moves the server to the state next returns for the current
+// state, the peer state and whether the leases of the peer are received.
+func (f *Failover) transition(next func(st FailoverState, peer FailoverState, synced bool) FailoverState) {
+	f.smu.Lock()
+	defer f.smu.Unlock()
+	f.mu.Lock()
+	old := f.state
+	st := next(old, f.peerState, f.synced)
+	if st == old {
+		f.mu.Unlock()
+		return
+	}
+	f.state = st
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	if st == FailoverCommunicationsInterrupted && f.config.AutoPartnerDown > 0 {
+		f.timer = time.AfterFunc(time.Second*time.Duration(f.config.AutoPartnerDown), func() {
+			_ = f.PartnerDown()
+		})
+	}
+	if st == FailoverRecover {
+		// the peer allocated our addresses meanwhile
+		f.synced = false
+	}
+	conn := f.conn
+	f.mu.Unlock()
+	log.Printf("Failover %s: %s -> %s", f.config.Name, old, st)
+
+	if old == FailoverPartnerDown || st == FailoverPartnerDown {
+		f.setPartnerDown(st == FailoverPartnerDown)
+	}
+	if conn == nil {
+		return
+	}
+	f.send(conn, f.stateMessage())
+	if st == FailoverRecover {
+		f.send(conn, f.newMessage(failoverUpdReqAll))
+	}
+	if st == FailoverNormal && f.secondary {
+		f.send(conn, f.newMessage(failoverPoolReq))
+	}
+}
+
+// serves reports whether the server answers the client of req in the
+// current state.
+func (f *Failover) serves(req *dhcpv4.DHCPv4) bool {
+	f.mu.Lock()
+	st := f.state
+	hba := f.hba
+	f.mu.Unlock()
+	switch st {
+	case FailoverNormal:
+		if !isLoadBalanced(req) {
+			return true
+		}
+		bucket := loadBalanceHash(req)
+		primary := hba[bucket/8]&(1<<(bucket%8)) != 0
+		return primary != f.secondary
+	case FailoverCommunicationsInterrupted, FailoverPartnerDown:
+		return true
+	}
+	return false
+}
+
+// update sends the lease changed by the server to the peer. Updates made
+// while the peer is disconnected are sent when it requests all of them.
+func (f *Failover) update(lease *Lease) {
+	f.mu.Lock()
+	conn := f.conn
+	f.mu.Unlock()
+	if conn != nil {
+		f.sendBinding(conn, lease)
+	}
+}
+
+// pendingBinding is the expiry of a lease sent to the peer.
+type pendingBinding struct {
+	pool   *failoverPool
+	ip     IPv4
+	expiry time.Time
+}
+
+// sendBinding sends BNDUPD for lease and keeps its expiry until the peer
+// acknowledges it.
+func (f *Failover) sendBinding(conn net.Conn, lease *Lease) {
+	m := f.bindingMessage(lease)
+	if m == nil {
+		return
+	}
+	b := pendingBinding{pool: f.pool(lease.Subnet)}
+	b.ip, _ = ParseIPv4(lease.IP)
+	if lease.State == LeaseStateBound && lease.LeaseTime > 0 {
+		b.expiry = lease.LastUpdate.Add(time.Second * time.Duration(lease.LeaseTime))
+	}
+	f.mu.Lock()
+	f.pending[m.XID] = b
+	f.mu.Unlock()
+	f.send(conn, m)
+}
+
+func (f *Failover) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if f.isClosed() {
+				return
+			}
+			log.Printf("failover %s: %s", f.config.Name, err)
+			time.Sleep(failoverRetry)
+			continue
+		}
+		go f.acceptPeer(conn)
+	}
+}
+
+// acceptPeer answers CONNECT of the primary server.
+func (f *Failover) acceptPeer(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(f.receiveTimer()))
+	m, err := readFailoverMessage(conn)
+	if err != nil || m.Type != failoverConnect {
+		log.Printf("failover %s: no CONNECT from %s: %v", f.config.Name, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	reason := f.checkConnect(m)
+	f.mu.Lock()
+	if reason == 0 && (f.conn != nil || f.closed) {
+		reason = rejectDuplicate
+	}
+	if reason == 0 {
+		f.conn = conn
+		if hba := m.get(failoverOptHashBucketAssignment); len(hba) == loadBalanceBuckets/8 {
+			f.hba = hba
+		}
+	}
+	f.mu.Unlock()
+	ack := f.connectMessage(failoverConnectAck)
+	if reason != 0 {
+		ack.addUint8(failoverOptRejectReason, reason)
+		f.send(conn, ack)
+		_ = conn.Close()
+		log.Printf("failover %s: rejected %s: reason %d", f.config.Name, conn.RemoteAddr(), reason)
+		return
+	}
+	f.send(conn, ack)
+	f.run(conn)
+}
+
+func (f *Failover) checkConnect(m *failoverMessage) uint8 {
+	if string(m.get(failoverOptRelationshipName)) != f.config.Name {
+		return rejectInvalidPartner
+	}
+	if version, _ := m.getUint8(failoverOptProtocolVersion); version != failoverProtocolVersion {
+		return rejectVersionMismatch
+	}
+	return 0
+}
+
+func (f *Failover) dial() {
+	for !f.isClosed() {
+		err := f.connect()
+		if err != nil && !f.isClosed() {
+			log.Printf("failover %s: %s", f.config.Name, err)
+		}
+		time.Sleep(failoverRetry)
+	}
+}
+
+// connect sends CONNECT to the secondary server and serves the connection.
+func (f *Failover) connect() error {
+	conn, err := net.DialTimeout("tcp", f.config.Peer, f.receiveTimer())
+	if err != nil {
+		return err
+	}
+	f.send(conn, f.connectMessage(failoverConnect))
+	_ = conn.SetReadDeadline(time.Now().Add(f.receiveTimer()))
+	m, err := readFailoverMessage(conn)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("no CONNECTACK from %s: %s", f.config.Peer, err)
+	}
+	if reason, ok := m.getUint8(failoverOptRejectReason); ok || m.Type != failoverConnectAck {
+		_ = conn.Close()
+		return fmt.Errorf("connection rejected by %s: reason %d", f.config.Peer, reason)
+	}
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		_ = conn.Close()
+		return nil
+	}
+	f.conn = conn
+	f.mu.Unlock()
+	f.run(conn)
+	return nil
+}
+
+// run exchanges states and leases with the connected peer until the
+// connection fails.
+func (f *Failover) run(conn net.Conn) {
+	log.Printf("Failover %s connected to %s", f.config.Name, conn.RemoteAddr())
+	f.send(conn, f.stateMessage())
+	f.send(conn, f.newMessage(failoverUpdReqAll))
+	stop := make(chan struct{})
+	go f.contact(conn, stop)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(f.receiveTimer()))
+		m, err := readFailoverMessage(conn)
+		if err != nil {
+			if !f.isClosed() {
+				log.Printf("failover %s: %s", f.config.Name, err)
+			}
+			break
+		}
+		f.handle(conn, m)
+	}
+	close(stop)
+	_ = conn.Close()
+
+	f.mu.Lock()
+	if f.conn == conn {
+		f.conn = nil
+		f.pending = make(map[uint32]pendingBinding)
+	}
+	f.peerState = 0
+	f.synced = false
+	f.mu.Unlock()
+	f.transition(func(st FailoverState, peer FailoverState, synced bool) FailoverState {
+		switch st {
+		case FailoverNormal, FailoverRecoverDone:
+			return FailoverCommunicationsInterrupted
+		}
+		return st
+	})
+}
+
+// contact keeps the connection alive while nothing else is sent.
+func (f *Failover) contact(conn net.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(f.receiveTimer() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			f.send(conn, f.newMessage(failoverContact))
+		}
+	}
+}
+
+func (f *Failover) handle(conn net.Conn, m *failoverMessage) {
+	switch m.Type {
+	case failoverState:
+		st, _ := m.getUint8(failoverOptServerState)
+		f.mu.Lock()
+		f.peerState = FailoverState(st)
+		f.mu.Unlock()
+		f.transition(f.afterPeerState)
+	case failoverUpdReq, failoverUpdReqAll:
+		// updates are not queued for the peer, so it gets all of them
+		f.sendAll(conn)
+	case failoverUpdDone:
+		f.mu.Lock()
+		f.synced = true
+		f.mu.Unlock()
+		f.transition(f.afterPeerState)
+	case failoverBndUpd:
+		ack := f.newMessage(failoverBndAck)
+		ack.XID = m.XID
+		ack.add(failoverOptAssignedIPAddress, m.get(failoverOptAssignedIPAddress))
+		if reason := f.applyBinding(m); reason != 0 {
+			ack.addUint8(failoverOptRejectReason, reason)
+		}
+		f.send(conn, ack)
+	case failoverBndAck:
+		f.mu.Lock()
+		b, pending := f.pending[m.XID]
+		delete(f.pending, m.XID)
+		f.mu.Unlock()
+		if reason, ok := m.getUint8(failoverOptRejectReason); ok {
+			log.Printf("failover %s: peer rejected binding %s: reason %d", f.config.Name, net.IP(m.get(failoverOptAssignedIPAddress)), reason)
+		} else if pending {
+			b.pool.ack(b.ip, b.expiry)
+		}
+	case failoverPoolReq:
+		f.transferPools(conn)
+	case failoverPoolResp:
+		transferred, _ := m.getUint32(failoverOptAddressesTransferred)
+		log.Printf("Failover %s: got %d backup addresses", f.config.Name, transferred)
+	case failoverContact:
+	case failoverDisconnect:
+		_ = conn.Close()
+	default:
+		log.Printf("failover %s: unexpected %s", f.config.Name, m)
+	}
+}
+
+// afterPeerState returns the state after the peer changed its state or
+// sent all its leases.
+func (f *Failover) afterPeerState(st FailoverState, peer FailoverState, synced bool) FailoverState {
+	switch {
+	case st == FailoverPartnerDown && peer == FailoverRecoverDone:
+		return FailoverNormal
+	case st == FailoverRecoverDone && (peer == FailoverNormal || peer == FailoverRecoverDone):
+		return FailoverNormal
+	case peer == FailoverPartnerDown && st != FailoverRecover && st != FailoverRecoverDone:
+		// if both assumed the other one down, the secondary server recovers
+		if st != FailoverPartnerDown || f.secondary {
+			return FailoverRecover
+		}
+	case !synced:
+	case st == FailoverRecover:
+		return FailoverRecoverDone
+	case st == FailoverStartup || st == FailoverCommunicationsInterrupted:
+		if peer != 0 && peer != FailoverRecover {
+			return FailoverNormal
+		}
+	}
+	return st
+}
+
+func (f *Failover) newMessage(t uint8) *failoverMessage {
+	f.mu.Lock()
+	f.xid++
+	xid := f.xid
+	f.mu.Unlock()
+	return &failoverMessage{Type: t, Time: uint32(time.Now().Unix()), XID: xid}
+}
+
+func (f *Failover) connectMessage(t uint8) *failoverMessage {
+	m := f.newMessage(t)
+	m.add(failoverOptRelationshipName, []byte(f.config.Name))
+	m.addUint8(failoverOptProtocolVersion, failoverProtocolVersion)
+	m.addUint32(failoverOptMCLT, uint32(f.config.MCLT))
+	m.addUint32(failoverOptMaxUnackedBndUpd, failoverMaxUnacked)
+	m.addUint32(failoverOptReceiveTimer, uint32(f.config.ReceiveTimer))
+	if !f.secondary {
+		m.add(failoverOptHashBucketAssignment, f.hba)
+	}
+	return m
+}
+
+func (f *Failover) stateMessage() *failoverMessage {
+	m := f.newMessage(failoverState)
+	m.addUint8(failoverOptServerState, uint8(f.State()))
+	return m
+}
+
+func (f *Failover) send(conn net.Conn, m *failoverMessage) {
+	data, err := m.encode()
+	if err != nil {
+		log.Printf("failover %s: %s", f.config.Name, err)
+		return
+	}
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	_ = conn.SetWriteDeadline(time.Now().Add(f.receiveTimer()))
+	_, err = conn.Write(data)
+	if err != nil {
+		log.Printf("failover %s: failed to send %s: %s", f.config.Name, m, err)
+		_ = conn.Close()
+	}
+}
+
+// bindingMessage returns BNDUPD for lease, or nil for offered leases, which
+// are not sent to the peer.
+func (f *Failover) bindingMessage(lease *Lease) *failoverMessage {
+	var status uint8
+	switch lease.State {
+	case LeaseStateBound:
+		status = bindingActive
+	case LeaseStateReleased:
+		status = bindingReleased
+	case LeaseStateExpired:
+		status = bindingExpired
+	case LeaseStateDeclined:
+		status = bindingAbandoned
+	default:
+		return nil
+	}
+	ip := net.ParseIP(lease.IP).To4()
+	if ip == nil {
+		return nil
+	}
+	m := f.newMessage(failoverBndUpd)
+	m.add(failoverOptAssignedIPAddress, ip)
+	m.addUint8(failoverOptBindingStatus, status)
+	if mac, err := net.ParseMAC(lease.MAC); err == nil {
+		m.add(failoverOptClientHardwareAddr, append([]byte{htypeEthernet}, mac...))
+	}
+	if id, err := hex.DecodeString(lease.ClientID); err == nil && len(id) > 0 {
+		m.add(failoverOptClientIdentifier, id)
+	}
+	m.addUint32(failoverOptClientLastTransTime, uint32(lease.LastUpdate.Unix()))
+	if lease.LeaseTime > 0 {
+		expiry := lease.LastUpdate.Add(time.Second * time.Duration(lease.LeaseTime))
+		m.addUint32(failoverOptLeaseExpirationTime, uint32(expiry.Unix()))
+		if status == bindingActive {
+			// the server asks the peer for no more than the client has, so
+			// leases it gives while the peer is unreachable stay within MCLT
+			// of the expiry the client was told
+			m.addUint32(failoverOptPotentialExpiration, uint32(expiry.Unix()))
+		}
+	}
+	return m
+}
+
+// poolMessage returns BNDUPD moving ip to the pool of the secondary server,
+// or back to the primary one.
+func (f *Failover) poolMessage(ip IPv4, backup bool) *failoverMessage {
+	m := f.newMessage(failoverBndUpd)
+	m.add(failoverOptAssignedIPAddress, net.ParseIP(ip.String()).To4())
+	if backup {
+		m.addUint8(failoverOptBindingStatus, bindingBackup)
+	} else {
+		m.addUint8(failoverOptBindingStatus, bindingFree)
+	}
+	return m
+}
+
+// applyBinding puts BNDUPD of the peer into the subnet cache and the lease
+// storage. It returns the reject reason for BNDACK, if any.
+func (f *Failover) applyBinding(m *failoverMessage) uint8 {
+	ipData := m.get(failoverOptAssignedIPAddress)
+	status, ok := m.getUint8(failoverOptBindingStatus)
+	if len(ipData) != net.IPv4len || !ok {
+		return rejectMissingBindingInfo
+	}
+	ip := net.IP(ipData)
+	f.server.mu.RLock()
+	subnet := f.server.subnetForIP(ip)
+	f.server.mu.RUnlock()
+	if subnet == nil {
+		return rejectIllegalAddress
+	}
+	addr, err := ParseIPv4(ip.String())
+	if err != nil {
+		return rejectIllegalAddress
+	}
+	switch status {
+	case bindingBackup, bindingFree:
+		subnet.setBackup(addr, status == bindingBackup)
+		return 0
+	}
+
+	lease := &Lease{Subnet: subnet.Subnet, IP: ip.String(), LastUpdate: time.Now()}
+	if hw := m.get(failoverOptClientHardwareAddr); len(hw) > 1 {
+		lease.MAC = net.HardwareAddr(hw[1:]).String()
+	}
+	if id := m.get(failoverOptClientIdentifier); len(id) > 0 {
+		lease.ClientID = hex.EncodeToString(id)
+	}
+	if cltt, ok := m.getUint32(failoverOptClientLastTransTime); ok {
+		lease.LastUpdate = time.Unix(int64(cltt), 0)
+	}
+	end, ok := m.getUint32(failoverOptLeaseExpirationTime)
+	leaseTime := int64(end) - lease.LastUpdate.Unix()
+	if ok && leaseTime > 0 {
+		lease.LeaseTime = int(leaseTime)
+	}
+	switch status {
+	case bindingActive:
+		if lease.LeaseTime == 0 {
+			// the subnet lease time would extend the lease the peer gave
+			return rejectMissingBindingInfo
+		}
+		lease.State = LeaseStateBound
+	case bindingReleased:
+		lease.State = LeaseStateReleased
+	case bindingAbandoned:
+		lease.State = LeaseStateDeclined
+	default:
+		lease.State = LeaseStateExpired
+	}
+	err = subnet.updateLease(lease)
+	if errors.Is(err, errOutdatedBinding) {
+		return rejectOutdatedBinding
+	}
+	if err != nil {
+		log.Printf("failover %s: %s", f.config.Name, err)
+		return rejectIllegalAddress
+	}
+	// the peer knows the lease it sent
+	var expiry time.Time
+	if lease.State == LeaseStateBound {
+		expiry = lease.LastUpdate.Add(time.Second * time.Duration(lease.LeaseTime))
+	}
+	f.pool(subnet.Subnet).ack(addr, expiry)
+	err = f.server.persistPeerLease(lease)
+	if err != nil {
+		log.Printf("failover %s: failed to persist lease %s: %s", f.config.Name, lease.IP, err)
+	}
+	return 0
+}
+
+// sendAll answers UPDREQALL with the leases and backup addresses of all subnets.
+func (f *Failover) sendAll(conn net.Conn) {
+	for _, subnet := range f.server.subnetList() {
+		leases, backup := subnet.failoverBindings()
+		for i := range leases {
+			f.sendBinding(conn, &leases[i])
+		}
+		for _, ip := range backup {
+			f.send(conn, f.poolMessage(ip, true))
+		}
+	}
+	f.send(conn, f.newMessage(failoverUpdDone))
+}
+
+// transferPools answers POOLREQ of the secondary server.
+func (f *Failover) transferPools(conn net.Conn) {
+	transferred := 0
+	if !f.secondary && f.State() == FailoverNormal {
+		for _, subnet := range f.server.subnetList() {
+			for _, ip := range subnet.transferPool() {
+				f.send(conn, f.poolMessage(ip, true))
+				transferred++
+			}
+		}
+	}
+	m := f.newMessage(failoverPoolResp)
+	m.addUint32(failoverOptAddressesTransferred, uint32(transferred))
+	f.send(conn, m)
+	log.Printf("Failover %s: transferred %d backup addresses", f.config.Name, transferred)
+}
+
+// pool returns the address pool of subnet shared by its reconfigured versions.
+func (f *Failover) pool(subnet string) *failoverPool {
+	f.poolMu.Lock()
+	defer f.poolMu.Unlock()
+	p, ok := f.pools[subnet]
+	if !ok {
+		p = &failoverPool{
+			secondary: f.secondary,
+			mclt:      time.Second * time.Duration(f.config.MCLT),
+			backup:    make(map[IPv4]bool),
+			acked:     make(map[IPv4]time.Time),
+		}
+		f.pools[subnet] = p
+	}
+	return p
+}
+
+func (f *Failover) setPartnerDown(down bool) {
+	f.poolMu.Lock()
+	defer f.poolMu.Unlock()
+	for _, p := range f.pools {
+		p.setDown(down)
+	}
+}
+
+// failoverPool tracks which addresses of a subnet the server may allocate:
+// the primary server owns free addresses, the secondary one owns backup
+// addresses, and a server in PARTNER-DOWN state allocates from the addresses
+// of the peer too. It keeps the lease expiries the peer knows about, which
+// limit lease times to MCLT beyond them.
+type failoverPool struct {
+	mu        sync.Mutex
+	secondary bool
+	mclt      time.Duration
+	// downSince is when the server entered PARTNER-DOWN state, zero otherwise.
+	downSince time.Time
+	backup    map[IPv4]bool
+	acked     map[IPv4]time.Time
+}
+
+// owns reports whether ip belongs to the server rather than to the peer,
+// which is always true without failover.
+func (p *failoverPool) owns(ip IPv4) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.backup[ip] == p.secondary
+}
+
+// takesOver reports whether the server may allocate the addresses of the
+// peer at now. The peer may have given its addresses to clients for MCLT
+// until it went down, so they are taken MCLT after PARTNER-DOWN state was
+// entered.
+func (p *failoverPool) takesOver(now time.Time) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.downSince.IsZero() && !now.Before(p.downSince.Add(p.mclt))
+}
+
+// ack records the expiry of the lease of ip the peer knows about. Zero
+// expiry means the peer knows ip is not leased.
+func (p *failoverPool) ack(ip IPv4, expiry time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if expiry.IsZero() {
+		delete(p.acked, ip)
+	} else {
+		p.acked[ip] = expiry
+	}
+}
+
+// maxExpiry returns the latest expiry of a lease of ip given at now: MCLT
+// after the expiry known to the peer, or after now if that passed.
+func (p *failoverPool) maxExpiry(ip IPv4, now time.Time) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expiry := p.acked[ip]
+	if expiry.Before(now) {
+		expiry = now
+	}
+	return expiry.Add(p.mclt)
+}
+
+func (p *failoverPool) setBackup(ip IPv4, backup bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if backup {
+		p.backup[ip] = true
+	} else {
+		delete(p.backup, ip)
+	}
+}
+
+func (p *failoverPool) setDown(down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !down {
+		p.downSince = time.Time{}
+	} else if p.downSince.IsZero() {
+		p.downSince = time.Now()
+	}
+}
+
+func (p *failoverPool) backupAddresses() []IPv4 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ips := make([]IPv4, 0, len(p.backup))
+	for ip := range p.backup {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// setPool makes the allocators of the subnet follow pool.
+func (s *Subnet) setPool(pool *failoverPool) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	s.attachPool(pool)
+	s.syncPool()
+}
+
+// attachPool splits the range of the subnet between the allocators of the
+// server and the peer according to pool. syncPool must follow once the
+// leases and hosts are in place.
+func (s *Subnet) attachPool(pool *failoverPool) {
+	s.pool = pool
+	// the allocator kind is checked by InitializeSubnet
+	s.peerAlloc, _ = newAllocator(s.Allocator, s.iPFrom, s.iPTo)
+	s.free = make(map[IPv4]bool)
+}
+
+// applyPool syncs the allocators with the pool after the subnet was configured.
+func (s *Subnet) applyPool() {
+	s = s.lock()
+	defer s.mu.Unlock()
+	s.syncPool()
+}
+
+func (s *Subnet) syncPool() {
+	for ip := s.iPFrom; ; ip++ {
+		s.syncAddress(ip)
+		if ip == s.iPTo {
+			break
+		}
+	}
+}
+
+// syncAddress passes ip to the allocator of the server or the peer owning
+// it as used by its lease or free, and holds it in the other one. Reserved
+// addresses are held in both.
+func (s *Subnet) syncAddress(ip IPv4) {
+	delete(s.free, ip)
+	if s.isReserved(ip) {
+		s.hold(ip)
+		return
+	}
+	if s.pool != nil {
+		if s.pool.owns(ip) {
+			s.peerAlloc.Use(ip, time.Time{})
+		} else {
+			s.alloc.Use(ip, time.Time{})
+		}
+	}
+	if lease := s.leases.ByIP(ip.String()); lease != nil {
+		s.track(lease)
+		return
+	}
+	s.freeAddress(ip.String())
+}
+
+// setBackup moves ip to the pool of the secondary server, or back to the
+// primary one.
+func (s *Subnet) setBackup(ip IPv4, backup bool) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	if s.pool == nil || ip < s.iPFrom || ip > s.iPTo {
+		return
+	}
+	s.pool.setBackup(ip, backup)
+	s.syncAddress(ip)
+}
+
+// transferPool moves free addresses of the primary server to the backup
+// pool until both servers own about the same number of free addresses, and
+// returns the moved ones.
+func (s *Subnet) transferPool() []IPv4 {
+	s = s.lock()
+	defer s.mu.Unlock()
+	if s.pool == nil {
+		return nil
+	}
+	now := time.Now()
+	backupFree := 0
+	for _, ip := range s.pool.backupAddresses() {
+		if lease := s.leases.ByIP(ip.String()); lease == nil || s.isExpired(lease, now) {
+			backupFree++
+		}
+	}
+	n := (len(s.free) - backupFree) / 2
+	if n <= 0 {
+		return nil
+	}
+	free := make([]IPv4, 0, len(s.free))
+	for ip := range s.free {
+		free = append(free, ip)
+	}
+	// the top of the range goes to the secondary server
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+	moved := free[len(free)-n:]
+	for _, ip := range moved {
+		s.pool.setBackup(ip, true)
+		s.syncAddress(ip)
+	}
+	return moved
+}
+
+// failoverBindings returns copies of the leases and the backup addresses
+// for the peer.
+func (s *Subnet) failoverBindings() ([]Lease, []IPv4) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	leases := make([]Lease, 0, s.leases.Len())
+	s.leases.Each(func(lease *Lease) {
+		leases = append(leases, *lease)
+	})
+	if s.pool == nil {
+		return leases, nil
+	}
+	return leases, s.pool.backupAddresses()
+}
+
+// updateLease puts a lease received from the failover peer. It returns
+// errOutdatedBinding if the cached lease of another client is more recent.
+func (s *Subnet) updateLease(lease *Lease) error {
+	s = s.lock()
+	defer s.mu.Unlock()
+	if !s.Contains(net.ParseIP(lease.IP)) {
+		return fmt.Errorf("lease %s is not in subnet %s", lease.IP, s.Subnet)
+	}
+	c := clientKey{mac: lease.MAC, id: lease.ClientID}
+	cached := s.leases.ByIP(lease.IP)
+	same := cached != nil && s.owns(cached, c)
+	if cached != nil && !same && cached.LastUpdate.After(lease.LastUpdate) && !s.isExpired(cached, time.Now()) {
+		return errOutdatedBinding
+	}
+	switch lease.State {
+	case LeaseStateReleased, LeaseStateExpired:
+		if same {
+			s.leases.Delete(cached)
+			s.freeAddress(lease.IP)
+		}
+		return nil
+	}
+	lease.Subnet = s.Subnet
+	lease.NetMask = s.netMask
+	lease.Gateway = s.Gateway
+	lease.DNS = s.DNS
+	lease.Options = s.Options
+	if same {
+		lease.Host = cached.Host
+		lease.Options = cached.Options
+	}
+	if lease.LeaseTime == 0 {
+		lease.LeaseTime = s.LeaseTime
+	}
+	if lease.State == LeaseStateBound {
+		s.limitPeerLease(lease, cached, same)
+	}
+	s.leases.Put(lease)
+	s.track(lease)
+	return nil
+}
+
+// limitPeerLease shortens a lease from the peer to MCLT beyond the expiry the
+// server acknowledged, which the peer must not exceed. The cached lease of the
+// client counts as acknowledged too, as acknowledgements are not kept across
+// restarts.
+func (s *Subnet) limitPeerLease(lease *Lease, cached *Lease, same bool) {
+	if s.pool == nil {
+		return
+	}
+	ip := s.leaseIP(lease)
+	known := lease.LastUpdate
+	if same && cached.State == LeaseStateBound && s.expiry(cached).After(known) {
+		known = s.expiry(cached)
+	}
+	limit := s.pool.maxExpiry(ip, known)
+	if s.expiry(lease).After(limit) {
+		log.Printf("subnet %s: lease %s from the peer expires after MCLT, shortened to %s", s.Subnet, lease.IP, limit)
+		lease.LeaseTime = int(limit.Sub(lease.LastUpdate) / time.Second)
+	}
+}
@@ -0,0 +1,229 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Failover message types (draft-ietf-dhc-failover-12 section 6.1).
+const (
+	failoverPoolReq    uint8 = 1
+	failoverPoolResp   uint8 = 2
+	failoverBndUpd     uint8 = 3
+	failoverBndAck     uint8 = 4
+	failoverConnect    uint8 = 5
+	failoverConnectAck uint8 = 6
+	failoverUpdReqAll  uint8 = 7
+	failoverUpdDone    uint8 = 8
+	failoverUpdReq     uint8 = 9
+	failoverState      uint8 = 10
+	failoverContact    uint8 = 11
+	failoverDisconnect uint8 = 12
+)
+
+// Failover options (draft-ietf-dhc-failover-12 section 12).
+const (
+	failoverOptAddressesTransferred uint16 = 1
+	failoverOptAssignedIPAddress    uint16 = 2
+	failoverOptBindingStatus        uint16 = 3
+	failoverOptClientIdentifier     uint16 = 4
+	failoverOptClientHardwareAddr   uint16 = 5
+	failoverOptClientLastTransTime  uint16 = 6
+	failoverOptHashBucketAssignment uint16 = 11
+	failoverOptLeaseExpirationTime  uint16 = 13
+	failoverOptMaxUnackedBndUpd     uint16 = 14
+	failoverOptMCLT                 uint16 = 15
+	failoverOptPotentialExpiration  uint16 = 18
+	failoverOptReceiveTimer         uint16 = 19
+	failoverOptProtocolVersion      uint16 = 20
+	failoverOptRejectReason         uint16 = 21
+	failoverOptRelationshipName     uint16 = 22
+	failoverOptServerState          uint16 = 24
+)
+
+// Binding status values of the binding-status option.
+const (
+	bindingFree      uint8 = 1
+	bindingActive    uint8 = 2
+	bindingExpired   uint8 = 3
+	bindingReleased  uint8 = 4
+	bindingAbandoned uint8 = 5
+	bindingBackup    uint8 = 7
+)
+
+// Reject reasons of the reject-reason option.
+const (
+	rejectIllegalAddress     uint8 = 1
+	rejectMissingBindingInfo uint8 = 3
+	rejectDuplicate          uint8 = 7
+	rejectInvalidPartner     uint8 = 8
+	rejectVersionMismatch    uint8 = 14
+	rejectOutdatedBinding    uint8 = 15
+)
+
+const (
+	failoverProtocolVersion = 1
+	failoverHeaderLength    = 12
+)
+
+type failoverOption struct {
+	code uint16
+	data []byte
+}
+
+// failoverMessage is a message of the failover protocol: the header
+// followed by options.
+type failoverMessage struct {
+	Type    uint8
+	Time    uint32
+	XID     uint32
+	options []failoverOption
+}
+
+func (m *failoverMessage) add(code uint16, data []byte) {
+	m.options = append(m.options, failoverOption{code: code, data: data})
+}
+
+func (m *failoverMessage) addUint8(code uint16, value uint8) {
+	m.add(code, []byte{value})
+}
+
+func (m *failoverMessage) addUint32(code uint16, value uint32) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	m.add(code, data)
+}
+
+// get returns the data of the first option code, or nil.
+func (m *failoverMessage) get(code uint16) []byte {
+	for _, opt := range m.options {
+		if opt.code == code {
+			return opt.data
+		}
+	}
+	return nil
+}
+
+func (m *failoverMessage) getUint8(code uint16) (uint8, bool) {
+	data := m.get(code)
+	if len(data) != 1 {
+		return 0, false
+	}
+	return data[0], true
+}
+
+func (m *failoverMessage) getUint32(code uint16) (uint32, bool) {
+	data := m.get(code)
+	if len(data) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data), true
+}
+
+func (m *failoverMessage) String() string {
+	return fmt.Sprintf("%s xid %d", failoverTypeName(m.Type), m.XID)
+}
+
+func (m *failoverMessage) encode() ([]byte, error) {
+	length := failoverHeaderLength
+	for _, opt := range m.options {
+		if len(opt.data) > 0xffff {
+			return nil, fmt.Errorf("failover option %d is too long", opt.code)
+		}
+		length += 4 + len(opt.data)
+	}
+	if length > 0xffff {
+		return nil, errors.New("failover message is too long")
+	}
+	data := make([]byte, failoverHeaderLength, length)
+	binary.BigEndian.PutUint16(data[0:], uint16(length))
+	data[2] = m.Type
+	data[3] = failoverHeaderLength
+	binary.BigEndian.PutUint32(data[4:], m.Time)
+	binary.BigEndian.PutUint32(data[8:], m.XID)
+	for _, opt := range m.options {
+		data = append(data, byte(opt.code>>8), byte(opt.code), byte(len(opt.data)>>8), byte(len(opt.data)))
+		data = append(data, opt.data...)
+	}
+	return data, nil
+}
+
+// readFailoverMessage reads one message from r.
+func readFailoverMessage(r io.Reader) (*failoverMessage, error) {
+	head := make([]byte, 2)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(head))
+	if length < failoverHeaderLength {
+		return nil, fmt.Errorf("invalid failover message length %d", length)
+	}
+	data := make([]byte, length)
+	copy(data, head)
+	_, err = io.ReadFull(r, data[2:])
+	if err != nil {
+		return nil, err
+	}
+	return decodeFailoverMessage(data)
+}
+
+func decodeFailoverMessage(data []byte) (*failoverMessage, error) {
+	if len(data) < failoverHeaderLength || int(binary.BigEndian.Uint16(data)) != len(data) {
+		return nil, errors.New("truncated failover message")
+	}
+	offset := int(data[3])
+	if offset < failoverHeaderLength || offset > len(data) {
+		return nil, fmt.Errorf("invalid failover payload offset %d", offset)
+	}
+	m := &failoverMessage{
+		Type: data[2],
+		Time: binary.BigEndian.Uint32(data[4:]),
+		XID:  binary.BigEndian.Uint32(data[8:]),
+	}
+	for payload := data[offset:]; len(payload) > 0; {
+		if len(payload) < 4 {
+			return nil, errors.New("truncated failover option")
+		}
+		code := binary.BigEndian.Uint16(payload)
+		size := int(binary.BigEndian.Uint16(payload[2:]))
+		if len(payload) < 4+size {
+			return nil, fmt.Errorf("truncated failover option %d", code)
+		}
+		m.add(code, payload[4:4+size])
+		payload = payload[4+size:]
+	}
+	return m, nil
+}
+
+func failoverTypeName(t uint8) string {
+	switch t {
+	case failoverPoolReq:
+		return "POOLREQ"
+	case failoverPoolResp:
+		return "POOLRESP"
+	case failoverBndUpd:
+		return "BNDUPD"
+	case failoverBndAck:
+		return "BNDACK"
+	case failoverConnect:
+		return "CONNECT"
+	case failoverConnectAck:
+		return "CONNECTACK"
+	case failoverUpdReqAll:
+		return "UPDREQALL"
+	case failoverUpdDone:
+		return "UPDDONE"
+	case failoverUpdReq:
+		return "UPDREQ"
+	case failoverState:
+		return "STATE"
+	case failoverContact:
+		return "CONTACT"
+	case failoverDisconnect:
+		return "DISCONNECT"
+	}
+	return fmt.Sprintf("type %d", t)
+}
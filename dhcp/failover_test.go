@@ -0,0 +1,303 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestFailoverMessage(t *testing.T) {
+	m := &failoverMessage{Type: failoverBndUpd, Time: 1000, XID: 7}
+	m.add(failoverOptAssignedIPAddress, []byte{10, 1, 1, 100})
+	m.addUint8(failoverOptBindingStatus, bindingActive)
+	m.addUint32(failoverOptLeaseExpirationTime, 5000)
+	data, err := m.encode()
+	assertNoError(t, err)
+	assertEqual(t, 12+8+5+8, len(data))
+
+	decoded, err := decodeFailoverMessage(data)
+	assertNoError(t, err)
+	assertEqual(t, failoverBndUpd, decoded.Type)
+	assertEqual(t, uint32(1000), decoded.Time)
+	assertEqual(t, uint32(7), decoded.XID)
+	assertEqual(t, "10.1.1.100", net.IP(decoded.get(failoverOptAssignedIPAddress)).String())
+	status, ok := decoded.getUint8(failoverOptBindingStatus)
+	assertTrue(t, ok)
+	assertEqual(t, bindingActive, status)
+	expiry, ok := decoded.getUint32(failoverOptLeaseExpirationTime)
+	assertTrue(t, ok)
+	assertEqual(t, uint32(5000), expiry)
+
+	_, err = decodeFailoverMessage(data[:len(data)-1])
+	assertTrue(t, err != nil)
+	data[len(data)-5] = 0xff // option length beyond the message
+	_, err = decodeFailoverMessage(data)
+	assertTrue(t, err != nil)
+}
+
+func TestFailover_Connect(t *testing.T) {
+	s := NewServer(ServerConfig{})
+	f, err := NewFailover(s, FailoverConfig{Name: "dhcp", Role: LoadBalanceSecondary, Laddr: "127.0.0.1:0"})
+	assertNoError(t, err)
+	m := (&Failover{config: FailoverConfig{Name: "other"}}).connectMessage(failoverConnect)
+	assertEqual(t, rejectInvalidPartner, f.checkConnect(m))
+	m = (&Failover{config: FailoverConfig{Name: "dhcp"}}).connectMessage(failoverConnect)
+	assertEqual(t, uint8(0), f.checkConnect(m))
+	maxUnacked, ok := m.getUint32(failoverOptMaxUnackedBndUpd)
+	assertTrue(t, ok)
+	assertEqual(t, uint32(failoverMaxUnacked), maxUnacked)
+
+	_, err = NewFailover(s, FailoverConfig{Name: "dhcp", Role: LoadBalancePrimary})
+	assertTrue(t, err != nil)
+	_, err = NewFailover(s, FailoverConfig{Name: "dhcp", Role: "backup", Peer: "127.0.0.1:647"})
+	assertTrue(t, err != nil)
+}
+
+func TestFailover_BindingMessage(t *testing.T) {
+	f := &Failover{}
+	now := time.Unix(1000, 0)
+	lease := &Lease{IP: "10.1.1.100", MAC: "00:00:00:00:00:01", State: LeaseStateBound, LeaseTime: 600, LastUpdate: now}
+	m := f.bindingMessage(lease)
+	expiry, ok := m.getUint32(failoverOptLeaseExpirationTime)
+	assertTrue(t, ok)
+	assertEqual(t, uint32(1600), expiry)
+	potential, ok := m.getUint32(failoverOptPotentialExpiration)
+	assertTrue(t, ok)
+	assertEqual(t, uint32(1600), potential)
+
+	// potential expiration is sent for active bindings only
+	lease.State = LeaseStateReleased
+	m = f.bindingMessage(lease)
+	assertTrue(t, m.get(failoverOptPotentialExpiration) == nil)
+	lease.State = LeaseStateOffered
+	assertTrue(t, f.bindingMessage(lease) == nil)
+}
+
+func TestSubnet_FailoverPool(t *testing.T) {
+	s := &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.4"}
+	_, err := InitializeSubnet(s)
+	assertNoError(t, err)
+	pool := &failoverPool{backup: make(map[IPv4]bool)}
+	s.setPool(pool)
+	client := func(n byte) *Lease {
+		return s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0, 0, 0, 0, 0, n}})
+	}
+
+	// the primary server keeps half of the free addresses
+	moved := s.transferPool()
+	assertEqual(t, 2, len(moved))
+	assertEqual(t, "10.1.1.3", moved[0].String())
+	assertEqual(t, "10.1.1.4", moved[1].String())
+	assertEqual(t, 2, len(s.free))
+	assertEqual(t, 0, len(s.transferPool()))
+	assertEqual(t, "10.1.1.1", client(1).IP)
+	assertEqual(t, "10.1.1.2", client(2).IP)
+	assertTrue(t, client(3) == nil)
+
+	// backup addresses are allocated in PARTNER-DOWN state only
+	pool.setDown(true)
+	assertEqual(t, "10.1.1.3", client(3).IP)
+	pool.setDown(false)
+	assertTrue(t, client(4) == nil)
+
+	// released backup address goes back to the secondary server
+	_, err = s.releaseLease(clientKey{mac: "00:00:00:00:00:03"}, net.ParseIP("10.1.1.3"))
+	assertNoError(t, err)
+	assertEqual(t, 0, len(s.free))
+	assertTrue(t, client(4) == nil)
+	addr, _ := ParseIPv4("10.1.1.3")
+	s.setBackup(addr, false)
+	assertTrue(t, s.free[addr])
+	assertEqual(t, "10.1.1.3", client(4).IP)
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 10)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func newFailoverServer(t *testing.T) (*Server, *FakeDHCPServer, *FakeResponder) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+	})
+	assertNoError(t, s.HandleListen(&Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}))
+	assertNoError(t, s.HandleSubnet(&Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.100", RangeTo: "10.1.1.109"}))
+	return s, fs, responder
+}
+
+// cachedLease returns a copy of the cached lease of ip, or nil.
+func cachedLease(s *Server, ip net.IP) *Lease {
+	subnet := s.subnetList()[0]
+	subnet.mu.Lock()
+	defer subnet.mu.Unlock()
+	if lease := subnet.leases.ByIP(ip.String()); lease != nil {
+		leaseCopy := *lease
+		return &leaseCopy
+	}
+	return nil
+}
+
+// canAllocate reports whether the server may give ip to a new client at now.
+func canAllocate(s *Server, ip IPv4, now time.Time) bool {
+	subnet := s.subnetList()[0]
+	subnet.mu.Lock()
+	defer subnet.mu.Unlock()
+	return subnet.canAllocate(ip, subnet.leases.ByIP(ip.String()), now)
+}
+
+// leaseMAC returns the MAC of the cached lease of ip.
+func leaseMAC(s *Server, ip net.IP) string {
+	subnet := s.subnetList()[0]
+	subnet.mu.Lock()
+	defer subnet.mu.Unlock()
+	if lease := subnet.leases.ByIP(ip.String()); lease != nil {
+		return lease.MAC
+	}
+	return ""
+}
+
+func TestFailover_Peers(t *testing.T) {
+	s1, fs1, responder1 := newFailoverServer(t)
+	s2, fs2, responder2 := newFailoverServer(t)
+	const mclt = time.Second * 2
+	secondary, err := NewFailover(s2, FailoverConfig{Name: "dhcp", Role: LoadBalanceSecondary, Laddr: "127.0.0.1:0", MCLT: 2, ReceiveTimer: 1})
+	assertNoError(t, err)
+	assertNoError(t, secondary.Start())
+	defer secondary.Close()
+	primaryConfig := FailoverConfig{Name: "dhcp", Role: LoadBalancePrimary, Peer: secondary.Addr().String(), Split: 128, MCLT: 2, ReceiveTimer: 1}
+	primary, err := NewFailover(s1, primaryConfig)
+	assertNoError(t, err)
+	assertNoError(t, primary.Start())
+
+	normal := func() bool {
+		return primary.State() == FailoverNormal && secondary.State() == FailoverNormal
+	}
+	waitFor(t, "NORMAL", normal)
+	// half of the free addresses are moved to the secondary server on POOLREQ
+	pool := s2.subnetList()[0].pool
+	waitFor(t, "POOLRESP", func() bool { return len(pool.backupAddresses()) == 5 })
+
+	// hashed to buckets 102 and 26 of the primary and 153 of the secondary server
+	mac1 := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	mac2 := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	mac3 := net.HardwareAddr{0, 0, 0, 0, 0, 4}
+	ip1 := runClient(fs1.handler, responder1, mac1)
+	assertTrue(t, ip1 != nil)
+	assertTrue(t, runClient(fs2.handler, responder2, mac1) == nil)
+	ip2 := runClient(fs2.handler, responder2, mac2)
+	assertTrue(t, ip2 != nil)
+	assertTrue(t, runClient(fs1.handler, responder1, mac2) == nil)
+	addr2, _ := ParseIPv4(ip2.String())
+	assertTrue(t, pool.owns(addr2))
+
+	// bindings are sent to the peer
+	waitFor(t, "BNDUPD", func() bool {
+		return leaseMAC(s2, ip1) == mac1.String() && leaseMAC(s1, ip2) == mac2.String()
+	})
+
+	// lease times exceed the expiry acknowledged by the peer by MCLT at most
+	addr1, _ := ParseIPv4(ip1.String())
+	pool1 := s1.subnetList()[0].pool
+	assertEqual(t, 2, cachedLease(s1, ip1).LeaseTime)
+	waitFor(t, "BNDACK", func() bool {
+		pool1.mu.Lock()
+		defer pool1.mu.Unlock()
+		return !pool1.acked[addr1].IsZero()
+	})
+	assertEqual(t, ip1.String(), runClient(fs1.handler, responder1, mac1).String())
+	assertEqual(t, 3, cachedLease(s1, ip1).LeaseTime)
+	waitFor(t, "renewal at the peer", func() bool {
+		lease := cachedLease(s2, ip1)
+		return lease != nil && lease.LeaseTime == 3
+	})
+
+	// the secondary server answers all clients when the primary one is down
+	primary.Close()
+	waitFor(t, "COMMUNICATIONS-INTERRUPTED", func() bool {
+		return secondary.State() == FailoverCommunicationsInterrupted
+	})
+	assertNoError(t, secondary.PartnerDown())
+	ip3 := runClient(fs2.handler, responder2, mac3)
+	assertTrue(t, ip3 != nil)
+	addr3, _ := ParseIPv4(ip3.String())
+	assertTrue(t, pool.owns(addr3))
+	assertEqual(t, 2, cachedLease(s2, ip3).LeaseTime)
+
+	// free addresses of the primary server are taken MCLT after PARTNER-DOWN,
+	// its leases MCLT after they expired
+	var free IPv4
+	for ip, _ := ParseIPv4("10.1.1.100"); free == 0; ip++ {
+		if !pool.owns(ip) && cachedLease(s2, net.ParseIP(ip.String())) == nil {
+			free = ip
+		}
+	}
+	now := time.Now()
+	assertTrue(t, !canAllocate(s2, free, now))
+	assertTrue(t, canAllocate(s2, free, now.Add(mclt)))
+	expiry := cachedLease(s2, ip1).LastUpdate.Add(time.Second * 3)
+	assertTrue(t, !canAllocate(s2, addr1, now.Add(mclt)))
+	assertTrue(t, !canAllocate(s2, addr1, expiry.Add(mclt).Add(-time.Millisecond)))
+	assertTrue(t, canAllocate(s2, addr1, expiry.Add(mclt).Add(time.Millisecond)))
+	time.Sleep(mclt)
+	mac5 := net.HardwareAddr{0, 0, 0, 0, 0, 5}
+	requestFree := dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP(free.String())))
+	assertEqual(t, free.String(), runClient(fs2.handler, responder2, mac5, requestFree).String())
+
+	// restarted primary server recovers the leases given meanwhile
+	primary, err = NewFailover(s1, primaryConfig)
+	assertNoError(t, err)
+	assertTrue(t, runClient(fs1.handler, responder1, mac3) == nil)
+	assertNoError(t, primary.Start())
+	defer primary.Close()
+	waitFor(t, "NORMAL after recovery", normal)
+	assertEqual(t, mac3.String(), leaseMAC(s1, ip3))
+	assertEqual(t, mac2.String(), leaseMAC(s1, ip2))
+
+	// the client keeps its address at the primary server
+	assertEqual(t, ip3.String(), runClient(fs1.handler, responder1, mac3).String())
+}
+
+func TestFailover_ApplyBinding(t *testing.T) {
+	s, _, _ := newFailoverServer(t)
+	f, err := NewFailover(s, FailoverConfig{Name: "dhcp", Role: LoadBalanceSecondary, Laddr: "127.0.0.1:0", MCLT: 60})
+	assertNoError(t, err)
+	ip := net.IP{10, 1, 1, 100}
+	binding := func(cltt time.Time, expiry time.Time) *failoverMessage {
+		m := &failoverMessage{Type: failoverBndUpd}
+		m.add(failoverOptAssignedIPAddress, ip)
+		m.addUint8(failoverOptBindingStatus, bindingActive)
+		m.add(failoverOptClientHardwareAddr, []byte{htypeEthernet, 0, 0, 0, 0, 0, 1})
+		m.addUint32(failoverOptClientLastTransTime, uint32(cltt.Unix()))
+		if !expiry.IsZero() {
+			m.addUint32(failoverOptLeaseExpirationTime, uint32(expiry.Unix()))
+		}
+		return m
+	}
+	now := time.Now()
+
+	// active bindings without a lease time are rejected
+	assertEqual(t, rejectMissingBindingInfo, f.applyBinding(binding(now, time.Time{})))
+	assertEqual(t, rejectMissingBindingInfo, f.applyBinding(binding(now, now)))
+	assertEqual(t, rejectMissingBindingInfo, f.applyBinding(binding(now, now.Add(-time.Hour))))
+	assertTrue(t, cachedLease(s, ip) == nil)
+
+	// lease times are limited to MCLT beyond the acknowledged expiry
+	assertEqual(t, uint8(0), f.applyBinding(binding(now, now.Add(time.Hour*2))))
+	assertEqual(t, 60, cachedLease(s, ip).LeaseTime)
+	assertEqual(t, uint8(0), f.applyBinding(binding(now, now.Add(time.Hour*2))))
+	assertEqual(t, 120, cachedLease(s, ip).LeaseTime)
+	assertEqual(t, uint8(0), f.applyBinding(binding(now, now.Add(time.Second*30))))
+	assertEqual(t, 30, cachedLease(s, ip).LeaseTime)
+}
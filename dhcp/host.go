@@ -0,0 +1,175 @@
+package dhcp
+
+import (
+	"fmt"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"net"
+	"time"
+)
+
+// Host is a static reservation of an address and options for a MAC, or for
+// a switch port identified by relay agent circuit-id and/or remote-id.
+type Host struct {
+	MAC       string `json:"mac,omitempty"`
+	CircuitID string `json:"circuitId,omitempty"`
+	RemoteID  string `json:"remoteId,omitempty"`
+	// Relay is the relay agent address (giaddr) of a port identified by
+	// circuit-id alone, which is unique per relay agent only.
+	Relay   string   `json:"relay,omitempty"`
+	IPv4    string   `json:"ipv4"`
+	Options []Option `json:"options,omitempty"`
+
+	ip IPv4
+}
+
+func InitializeHost(host *Host) (*Host, error) {
+	var err error
+	if host.MAC != "" {
+		if host.CircuitID != "" || host.RemoteID != "" || host.Relay != "" {
+			return nil, fmt.Errorf("host %s: either mac or circuit-id/remote-id must be set", host.MAC)
+		}
+		mac, err := net.ParseMAC(host.MAC)
+		if err != nil {
+			return nil, err
+		}
+		host.MAC = mac.String()
+	} else if host.CircuitID == "" && host.RemoteID == "" {
+		return nil, fmt.Errorf("host %s: mac, circuit-id or remote-id is required", host.IPv4)
+	} else if host.RemoteID != "" {
+		if host.Relay != "" {
+			return nil, fmt.Errorf("host %s: relay is used with circuit-id alone", host.IPv4)
+		}
+	} else {
+		relay := net.ParseIP(host.Relay).To4()
+		if relay == nil {
+			return nil, fmt.Errorf("host %s: relay address is required for circuit-id without remote-id", host.IPv4)
+		}
+		host.Relay = relay.String()
+	}
+	host.ip, err = ParseIPv4(host.IPv4)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range host.Options {
+		err = opt.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return host, nil
+}
+
+// Key identifies the host by MAC or by relay agent information.
+func (h *Host) Key() string {
+	if h.MAC != "" {
+		return h.MAC
+	}
+	return relayKey(h.Relay, h.CircuitID, h.RemoteID)
+}
+
+// AddHost reserves the host address in the subnet. Previous reservation for
+// the same host is replaced.
+func (s *Subnet) AddHost(host *Host) error {
+	s = s.lock()
+	defer s.mu.Unlock()
+	return s.addHost(host)
+}
+
+func (s *Subnet) addHost(host *Host) error {
+	if !s.Contains(net.ParseIP(host.IPv4)) {
+		return fmt.Errorf("host %s address %s is not in subnet %s", host.Key(), host.IPv4, s.Subnet)
+	}
+	if key, ok := s.reserved[host.ip]; ok && key != host.Key() {
+		return fmt.Errorf("address %s is already reserved for %s", host.IPv4, key)
+	}
+	s.removeHost(host.Key())
+	s.hosts[host.Key()] = host
+	s.reserved[host.ip] = host.Key()
+	delete(s.free, host.ip)
+	s.hold(host.ip)
+	return nil
+}
+
+func (s *Subnet) RemoveHost(key string) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	s.removeHost(key)
+}
+
+func (s *Subnet) removeHost(key string) {
+	host, ok := s.hosts[key]
+	if !ok {
+		return
+	}
+	delete(s.hosts, key)
+	delete(s.reserved, host.ip)
+	s.syncAddress(host.ip)
+}
+
+// findHost returns the reservation for the client of req, if any.
+func (s *Subnet) findHost(req *dhcpv4.DHCPv4) *Host {
+	for _, key := range hostKeys(req) {
+		if host, ok := s.hosts[key]; ok {
+			return host
+		}
+	}
+	return nil
+}
+
+func (s *Subnet) isReserved(ip IPv4) bool {
+	_, ok := s.reserved[ip]
+	return ok
+}
+
+// hostLease returns the lease of client c for the reserved address of host.
+// Address reserved for a switch port moves to the device currently on the
+// port once the lease of the former device expired or was released. Until
+// then the new device gets no address, since the former one may still use it.
+func (s *Subnet) hostLease(host *Host, c clientKey) *Lease {
+	lease := s.clientLease(c)
+	if lease != nil && lease.IP == host.IPv4 {
+		if lease.State == LeaseStateOffered {
+			s.refreshOffer(lease)
+		}
+		return lease
+	}
+	if lease != nil {
+		// dynamic lease given before the reservation
+		s.leases.Delete(lease)
+		s.freeAddress(lease.IP)
+	}
+	lease = s.leases.ByIP(host.IPv4)
+	if lease != nil && !s.owns(lease, c) {
+		// offered address is not used until the client is acknowledged
+		if lease.State != LeaseStateOffered && !s.isExpired(lease, time.Now()) {
+			return nil
+		}
+		s.expireLease(lease)
+	}
+	lease = s.newLease(host.ip, c)
+	lease.Host = host.Key()
+	lease.Options = s.optionsFor(lease.Host)
+	return lease
+}
+
+// optionsFor returns subnet options overridden by the options of the host with key.
+func (s *Subnet) optionsFor(key string) []Option {
+	host, ok := s.hosts[key]
+	if !ok || len(host.Options) == 0 {
+		return s.Options
+	}
+	options := make([]Option, 0, len(s.Options)+len(host.Options))
+	for _, opt := range s.Options {
+		overridden := false
+		for _, hostOpt := range host.Options {
+			if hostOpt.ID == opt.ID {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			options = append(options, opt)
+		}
+	}
+	return append(options, host.Options...)
+}
@@ -0,0 +1,187 @@
+package dhcp
+
+import (
+	"encoding/hex"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// LeaseStore indexes leases by address, MAC, client identifier and the client
+// key selected by LeaseKey. Every lease is indexed by address; declined leases
+// are not indexed by client, since the client must not get the address back.
+// LeaseStore is not safe for concurrent use, Subnet serializes access to it.
+type LeaseStore struct {
+	leaseKey   string
+	byIP       map[string]*Lease
+	byMAC      map[string]*Lease
+	byClientID map[string]*Lease
+	byClient   map[string]*Lease
+	keys       map[*Lease]leaseKeys
+}
+
+// leaseKeys are the index keys a lease is stored under.
+type leaseKeys struct {
+	ip       string
+	mac      string
+	clientID string
+	client   string
+}
+
+// NewLeaseStore returns a store matching leases to clients by leaseKey.
+func NewLeaseStore(leaseKey string) *LeaseStore {
+	return &LeaseStore{
+		leaseKey:   leaseKey,
+		byIP:       make(map[string]*Lease),
+		byMAC:      make(map[string]*Lease),
+		byClientID: make(map[string]*Lease),
+		byClient:   make(map[string]*Lease),
+		keys:       make(map[*Lease]leaseKeys),
+	}
+}
+
+// Lease keys for Subnet.LeaseKey, which select how a lease is matched to its client.
+const (
+	// LeaseKeyChaddr matches leases by client hardware address.
+	LeaseKeyChaddr = "chaddr"
+	// LeaseKeyClientID matches leases by client identifier (option 61), or by
+	// hardware address for clients which send none (RFC 2131 4.2).
+	LeaseKeyClientID = "client-id"
+	// LeaseKeyBoth matches leases by both hardware address and client identifier.
+	LeaseKeyBoth = "both"
+)
+
+// clientKey identifies the client of a request.
+type clientKey struct {
+	mac string
+	id  string
+}
+
+func clientKeyOf(req *dhcpv4.DHCPv4) clientKey {
+	return clientKey{mac: req.ClientHWAddr.String(), id: clientID(req)}
+}
+
+func (c clientKey) String() string {
+	if c.id == "" {
+		return c.mac
+	}
+	return c.mac + " (" + c.id + ")"
+}
+
+// clientID returns the client identifier (option 61) of req in hex, if any.
+func clientID(req *dhcpv4.DHCPv4) string {
+	id := req.Options.Get(dhcpv4.OptionClientIdentifier)
+	if len(id) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// index returns the key the lease of client c is indexed under. Leases of
+// clients which LeaseKey tells apart never share the key.
+func (st *LeaseStore) index(c clientKey) string {
+	switch st.leaseKey {
+	case LeaseKeyClientID:
+		if c.id != "" {
+			return "id/" + c.id
+		}
+		return "mac/" + c.mac
+	case LeaseKeyBoth:
+		return c.mac + "/" + c.id
+	default:
+		return c.mac
+	}
+}
+
+func (st *LeaseStore) ByIP(ip string) *Lease {
+	return st.byIP[ip]
+}
+
+func (st *LeaseStore) ByMAC(mac string) *Lease {
+	return st.byMAC[mac]
+}
+
+func (st *LeaseStore) ByClientID(id string) *Lease {
+	return st.byClientID[id]
+}
+
+// ByClient returns the lease of client c according to LeaseKey.
+func (st *LeaseStore) ByClient(c clientKey) *Lease {
+	return st.byClient[st.index(c)]
+}
+
+func (st *LeaseStore) Len() int {
+	return len(st.byIP)
+}
+
+// Each calls fn for every lease.
+func (st *LeaseStore) Each(fn func(*Lease)) {
+	for _, lease := range st.byIP {
+		fn(lease)
+	}
+}
+
+// Put stores lease or updates its index after the address, MAC, client
+// identifier or state changed. A lease holding the same address is removed
+// together with its client entries, so the address is reassigned at once.
+// Another lease of the same client stays indexed by its address only.
+func (st *LeaseStore) Put(lease *Lease) {
+	st.Delete(lease)
+	if old, ok := st.byIP[lease.IP]; ok {
+		st.Delete(old)
+	}
+	keys := leaseKeys{ip: lease.IP}
+	if lease.State != LeaseStateDeclined {
+		keys.mac = lease.MAC
+		keys.clientID = lease.ClientID
+		if lease.MAC != "" || lease.ClientID != "" {
+			keys.client = st.index(clientKey{mac: lease.MAC, id: lease.ClientID})
+		}
+	}
+	st.byIP[keys.ip] = lease
+	if keys.mac != "" {
+		if other, ok := st.byMAC[keys.mac]; ok {
+			otherKeys := st.keys[other]
+			otherKeys.mac = ""
+			st.keys[other] = otherKeys
+		}
+		st.byMAC[keys.mac] = lease
+	}
+	if keys.clientID != "" {
+		if other, ok := st.byClientID[keys.clientID]; ok {
+			otherKeys := st.keys[other]
+			otherKeys.clientID = ""
+			st.keys[other] = otherKeys
+		}
+		st.byClientID[keys.clientID] = lease
+	}
+	if keys.client != "" {
+		if other, ok := st.byClient[keys.client]; ok {
+			otherKeys := st.keys[other]
+			otherKeys.client = ""
+			st.keys[other] = otherKeys
+		}
+		st.byClient[keys.client] = lease
+	}
+	st.keys[lease] = keys
+}
+
+// Delete removes lease from all indices.
+func (st *LeaseStore) Delete(lease *Lease) {
+	keys, ok := st.keys[lease]
+	if !ok {
+		return
+	}
+	delete(st.keys, lease)
+	if st.byIP[keys.ip] == lease {
+		delete(st.byIP, keys.ip)
+	}
+	if keys.mac != "" && st.byMAC[keys.mac] == lease {
+		delete(st.byMAC, keys.mac)
+	}
+	if keys.clientID != "" && st.byClientID[keys.clientID] == lease {
+		delete(st.byClientID, keys.clientID)
+	}
+	if keys.client != "" && st.byClient[keys.client] == lease {
+		delete(st.byClient, keys.client)
+	}
+}
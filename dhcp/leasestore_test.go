@@ -0,0 +1,134 @@
+package dhcp
+
+import (
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLeaseStore_Put(t *testing.T) {
+	st := NewLeaseStore(LeaseKeyChaddr)
+	l1 := &Lease{IP: "10.1.1.1", MAC: "00:00:00:00:00:01", ClientID: "0100", State: LeaseStateBound}
+	st.Put(l1)
+	assertTrue(t, st.ByIP("10.1.1.1") == l1)
+	assertTrue(t, st.ByMAC("00:00:00:00:00:01") == l1)
+	assertTrue(t, st.ByClientID("0100") == l1)
+
+	// address is reassigned to another client
+	l2 := &Lease{IP: "10.1.1.1", MAC: "00:00:00:00:00:02", State: LeaseStateOffered}
+	st.Put(l2)
+	assertTrue(t, st.ByIP("10.1.1.1") == l2)
+	assertTrue(t, st.ByMAC("00:00:00:00:00:01") == nil)
+	assertTrue(t, st.ByClientID("0100") == nil)
+	assertEqual(t, 1, st.Len())
+
+	// client moves to another address, the old one stays leased
+	l3 := &Lease{IP: "10.1.1.2", MAC: "00:00:00:00:00:02", State: LeaseStateOffered}
+	st.Put(l3)
+	assertTrue(t, st.ByMAC("00:00:00:00:00:02") == l3)
+	assertTrue(t, st.ByIP("10.1.1.1") == l2)
+	assertEqual(t, 2, st.Len())
+	st.Delete(l2)
+	assertTrue(t, st.ByMAC("00:00:00:00:00:02") == l3)
+	assertTrue(t, st.ByIP("10.1.1.1") == nil)
+
+	// declined address is kept for the address only
+	l3.State = LeaseStateDeclined
+	st.Put(l3)
+	assertTrue(t, st.ByIP("10.1.1.2") == l3)
+	assertTrue(t, st.ByMAC("00:00:00:00:00:02") == nil)
+
+	// changed MAC of a stored lease
+	l3.State = LeaseStateBound
+	l3.MAC = "00:00:00:00:00:03"
+	st.Put(l3)
+	assertTrue(t, st.ByMAC("00:00:00:00:00:03") == l3)
+	assertTrue(t, st.ByMAC("00:00:00:00:00:02") == nil)
+	st.Delete(l3)
+	assertEqual(t, 0, st.Len())
+	assertTrue(t, st.ByMAC("00:00:00:00:00:03") == nil)
+}
+
+func TestSubnet_LeaseStore(t *testing.T) {
+	s := &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.1", OfferHoldTime: 10}
+	_, err := InitializeSubnet(s)
+	assertNoError(t, err)
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 1}, dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte{1, 0, 0, 0, 0, 0, 1})))
+	assertNoError(t, err)
+	l1 := s.GetLeaseForMAC(req)
+	assertEqual(t, "01000000000001", l1.ClientID)
+	assertTrue(t, s.leases.ByClientID(l1.ClientID) == l1)
+
+	// expired offer is taken over by another client
+	ageLease(s, l1, time.Second*11)
+	l2 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0, 0, 0, 0, 0, 2}})
+	assertEqual(t, "10.1.1.1", l2.IP)
+	assertTrue(t, s.leases.ByMAC("00:00:00:00:00:01") == nil)
+	assertTrue(t, s.leases.ByClientID(l1.ClientID) == nil)
+	assertEqual(t, 1, s.leases.Len())
+}
+
+func TestSubnet_LeaseKey(t *testing.T) {
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	newReq := func(id string) *dhcpv4.DHCPv4 {
+		req := &dhcpv4.DHCPv4{ClientHWAddr: mac}
+		if id != "" {
+			req.UpdateOption(dhcpv4.OptClientIdentifier([]byte(id)))
+		}
+		return req
+	}
+	newSubnet := func(key string) *Subnet {
+		s := &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.10", LeaseKey: key}
+		_, err := InitializeSubnet(s)
+		assertNoError(t, err)
+		return s
+	}
+
+	// chaddr: client id does not matter
+	s := newSubnet("")
+	assertEqual(t, LeaseKeyChaddr, s.LeaseKey)
+	assertEqual(t, "10.1.1.1", s.GetLeaseForMAC(newReq("pxe")).IP)
+	assertEqual(t, "10.1.1.1", s.GetLeaseForMAC(newReq("os")).IP)
+
+	// client-id: cloned MAC gets its own lease, clients without id are matched by MAC
+	s = newSubnet(LeaseKeyClientID)
+	assertEqual(t, "10.1.1.1", s.GetLeaseForMAC(newReq("vm1")).IP)
+	assertEqual(t, "10.1.1.2", s.GetLeaseForMAC(newReq("vm2")).IP)
+	assertEqual(t, "10.1.1.1", s.GetLeaseForMAC(newReq("vm1")).IP)
+	assertEqual(t, "10.1.1.3", s.GetLeaseForMAC(newReq("")).IP)
+	assertEqual(t, "10.1.1.3", s.GetLeaseForMAC(newReq("")).IP)
+	other := &dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0, 0, 0, 0, 0, 2}}
+	other.UpdateOption(dhcpv4.OptClientIdentifier([]byte("vm2")))
+	assertEqual(t, "10.1.1.2", s.GetLeaseForMAC(other).IP)
+	assertNoError(t, s.checkLease(clientKeyOf(newReq("vm1")), net.ParseIP("10.1.1.1")))
+	assertTrue(t, s.checkLease(clientKeyOf(newReq("vm2")), net.ParseIP("10.1.1.1")) != nil)
+	_, err := s.releaseLease(clientKeyOf(newReq("vm2")), net.ParseIP("10.1.1.1"))
+	assertTrue(t, err != nil)
+	_, err = s.releaseLease(clientKeyOf(newReq("vm1")), net.ParseIP("10.1.1.1"))
+	assertNoError(t, err)
+
+	// both: either change makes a new client
+	s = newSubnet(LeaseKeyBoth)
+	assertEqual(t, "10.1.1.1", s.GetLeaseForMAC(newReq("pxe")).IP)
+	assertEqual(t, "10.1.1.2", s.GetLeaseForMAC(newReq("os")).IP)
+	assertEqual(t, "10.1.1.2", s.GetLeaseForMAC(newReq("os")).IP)
+	assertEqual(t, "10.1.1.3", s.GetLeaseForMAC(other).IP)
+
+	// both: clones sending the same client id keep their leases
+	clone := &dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0, 0, 0, 0, 0, 2}}
+	clone.UpdateOption(dhcpv4.OptClientIdentifier([]byte("pxe")))
+	assertEqual(t, "10.1.1.4", s.GetLeaseForMAC(clone).IP)
+	assertEqual(t, "10.1.1.1", s.GetLeaseForMAC(newReq("pxe")).IP)
+	assertEqual(t, "10.1.1.4", s.GetLeaseForMAC(clone).IP)
+
+	// client-id: client without id keeps its lease after the same MAC sent an id
+	s = newSubnet(LeaseKeyClientID)
+	assertEqual(t, "10.1.1.1", s.GetLeaseForMAC(newReq("")).IP)
+	assertEqual(t, "10.1.1.2", s.GetLeaseForMAC(newReq("os")).IP)
+	assertEqual(t, "10.1.1.1", s.GetLeaseForMAC(newReq("")).IP)
+	assertEqual(t, "10.1.1.2", s.GetLeaseForMAC(newReq("os")).IP)
+
+	_, err = InitializeSubnet(&Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.10", LeaseKey: "duid"})
+	assertTrue(t, err != nil)
+}
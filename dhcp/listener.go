@@ -11,12 +11,20 @@ import (
 
 type ResponseGetter func(*dhcpv4.DHCPv4, *Listen) (*dhcpv4.DHCPv4, error)
 
+// NotificationHandler processes client messages which are not answered, like RELEASE and DECLINE.
+type NotificationHandler func(*dhcpv4.DHCPv4, *Listen) error
+
 type Listener struct {
-	server         DHCPv4Server
-	responseGetter ResponseGetter
-	responder      Responder
-	listen         *Listen
-	serverIPAddr   net.IP
+	server              DHCPv4Server
+	responseGetter      ResponseGetter
+	notificationHandler NotificationHandler
+	responder           Responder
+	listen              *Listen
+	serverIPAddr        net.IP
+	// serving is set while Serve reads requests, exitErr once it returned
+	// unexpectedly. Both are guarded by Server.mu.
+	serving bool
+	exitErr error
 }
 
 type DHCPv4Server interface {
@@ -42,12 +50,17 @@ func (l Listener) String() string {
 	return fmt.Sprintf("[Listener [if:%q subnet:%q laddr:%q]]", l.listen.Interface, l.listen.Subnet, l.listen.Laddr)
 }
 
-func NewListener(listen *Listen, handler ResponseGetter, serverFactory DHCPv4ServerFactory, responderFactory ResponderFactory) (*Listener, error) {
+func NewListener(listen *Listen, handler ResponseGetter, notificationHandler NotificationHandler, serverFactory DHCPv4ServerFactory, responderFactory ResponderFactory) (*Listener, error) {
 	responder, err := responderFactory.NewResponder(listen)
 	if err != nil {
 		return nil, err
 	}
-	listener := &Listener{responseGetter: handler, responder: responder, listen: listen}
+	listener := &Listener{
+		responseGetter:      handler,
+		notificationHandler: notificationHandler,
+		responder:           responder,
+		listen:              listen,
+	}
 	listener.server, err = serverFactory.NewServer(listen.Interface, listen.Laddr, listener.Handler)
 	if err != nil {
 		return nil, err
@@ -67,6 +80,14 @@ func (l *Listener) Handler(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv
 		resp, err = l.handleDiscover(req)
 	case dhcpv4.MessageTypeRequest:
 		resp, err = l.handleRequest(req)
+	case dhcpv4.MessageTypeInform:
+		resp, err = l.handleInform(req)
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		err = l.notificationHandler(req, l.listen)
+		if err != nil {
+			log.Printf("failed to handle %s: %s", req.MessageType(), err)
+		}
+		return
 	default:
 		log.Printf("unknown dhcp packet type %s", req.MessageType())
 		return
@@ -75,16 +96,32 @@ func (l *Listener) Handler(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv
 		log.Println(err)
 		return
 	}
-	if req.GatewayIPAddr == nil || req.GatewayIPAddr.Equal(net.IPv4zero) {
-		err = l.responder.SendBroadcast(resp)
-		if err != nil {
-			log.Printf("failed to send broadcast dhcp response: %s", err)
-		}
-		return
-	}
-	err = l.responder.SendUnicast(resp, peer)
+	err = l.send(req, resp)
 	if err != nil {
-		log.Printf("failed to send unicast dhcp response: %s", err)
+		log.Printf("failed to send dhcp response: %s", err)
+	}
+}
+
+// send delivers resp to the client as described in RFC 2131 4.1.
+func (l *Listener) send(req *dhcpv4.DHCPv4, resp *dhcpv4.DHCPv4) error {
+	hasClientIP := req.ClientIPAddr != nil && !req.ClientIPAddr.Equal(net.IPv4zero)
+	switch {
+	case req.MessageType() == dhcpv4.MessageTypeInform && hasClientIP:
+		// reply to INFORM is always sent to ciaddr
+		return l.responder.SendUnicast(resp, &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort})
+	case isRelayed(req):
+		// relay agent listens on the server port
+		return l.responder.SendUnicast(resp, &net.UDPAddr{IP: req.GatewayIPAddr, Port: dhcpv4.ServerPort})
+	case resp.MessageType() == dhcpv4.MessageTypeNak:
+		return l.responder.SendBroadcast(resp)
+	case hasClientIP:
+		// RENEWING client
+		return l.responder.SendUnicast(resp, &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort})
+	case req.IsBroadcast():
+		return l.responder.SendBroadcast(resp)
+	default:
+		// client has no address yet, so it can only be reached by chaddr
+		return l.responder.SendHardwareUnicast(resp)
 	}
 }
 
@@ -102,6 +139,22 @@ func (l *Listener) handleDiscover(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
 }
 
 func (l *Listener) handleRequest(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	resp, err := l.responseGetter(req, l.listen)
+	if err != nil {
+		return resp, err
+	}
+	if resp == nil {
+		return resp, errors.New("nil response")
+	}
+	if resp.MessageType() == dhcpv4.MessageTypeNak {
+		return resp, err
+	}
+	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	resp.ServerIPAddr = l.serverIPAddr
+	return resp, err
+}
+
+func (l *Listener) handleInform(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
 	resp, err := l.responseGetter(req, l.listen)
 	if err != nil {
 		return resp, err
@@ -114,7 +167,10 @@ func (l *Listener) handleRequest(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
 	return resp, err
 }
 
-func (l *Listener) Serve() error {
+// Serve answers requests until the server is closed. The socket is opened by
+// NewListener, started is called when Serve starts reading from it.
+func (l *Listener) Serve(started func()) error {
 	defer l.responder.Close()
+	started()
 	return l.server.Serve()
 }
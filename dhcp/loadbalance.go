@@ -0,0 +1,101 @@
+package dhcp
+
+import (
+	"fmt"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Load balancing roles, see LoadBalance.
+const (
+	LoadBalancePrimary   = "primary"
+	LoadBalanceSecondary = "secondary"
+)
+
+// loadBalanceBuckets is the number of hash buckets clients are split into.
+const loadBalanceBuckets = 256
+
+// LoadBalance splits the clients of a subnet between two servers without
+// shared lease storage (RFC 3074). Each client is hashed into one of 256
+// buckets, the primary server answers the buckets below Split and the
+// secondary server answers the rest.
+type LoadBalance struct {
+	// Role is LoadBalancePrimary or LoadBalanceSecondary.
+	Role string `json:"role"`
+	// Split is the number of buckets answered by the primary server, 128 splits the clients evenly.
+	Split int `json:"split"`
+	// PeerDown makes the server answer all clients while the peer is down.
+	PeerDown bool `json:"peerDown,omitempty"`
+}
+
+func (lb *LoadBalance) validate() error {
+	switch lb.Role {
+	case LoadBalancePrimary, LoadBalanceSecondary:
+	default:
+		return fmt.Errorf("unknown load balancing role %q", lb.Role)
+	}
+	if lb.Split < 0 || lb.Split > loadBalanceBuckets {
+		return fmt.Errorf("invalid load balancing split %d", lb.Split)
+	}
+	return nil
+}
+
+// serves reports whether the server answers the client of req.
+func (lb *LoadBalance) serves(req *dhcpv4.DHCPv4) bool {
+	if lb.PeerDown {
+		return true
+	}
+	primary := int(loadBalanceHash(req)) < lb.Split
+	return primary == (lb.Role == LoadBalancePrimary)
+}
+
+// isLoadBalanced reports whether req is answered by one server only, which
+// are DISCOVER and REQUEST in INIT-REBOOT state. Clients renewing or
+// rebinding a lease are answered by the server which knows their lease.
+func isLoadBalanced(req *dhcpv4.DHCPv4) bool {
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		return true
+	case dhcpv4.MessageTypeRequest:
+		return req.ServerIdentifier() == nil && (req.ClientIPAddr == nil || req.ClientIPAddr.IsUnspecified())
+	}
+	return false
+}
+
+// loadBalanceHash returns the bucket of the client of req, which is hashed by
+// the client identifier, or by the hardware address if there is none.
+func loadBalanceHash(req *dhcpv4.DHCPv4) uint8 {
+	key := req.Options.Get(dhcpv4.OptionClientIdentifier)
+	if len(key) == 0 {
+		key = req.ClientHWAddr
+	}
+	return pearsonHash(key)
+}
+
+// pearsonHash is the hash function of RFC 3074 section 6.
+func pearsonHash(key []byte) uint8 {
+	hash := uint8(len(key))
+	for i := len(key) - 1; i >= 0; i-- {
+		hash = loadBalanceMixTable[hash^key[i]]
+	}
+	return hash
+}
+
+var loadBalanceMixTable = [256]uint8{
+	251, 175, 119, 215, 81, 14, 79, 191, 103, 49, 181, 143, 186, 157, 0, 232,
+	31, 32, 55, 60, 152, 58, 17, 237, 174, 70, 160, 144, 220, 90, 57, 223,
+	59, 3, 18, 140, 111, 166, 203, 196, 134, 243, 124, 95, 222, 179, 197, 65,
+	180, 48, 36, 15, 107, 46, 233, 130, 165, 30, 123, 161, 209, 23, 97, 16,
+	40, 91, 219, 61, 100, 10, 210, 109, 250, 127, 22, 138, 29, 108, 244, 67,
+	207, 9, 178, 204, 74, 98, 126, 249, 167, 116, 34, 77, 193, 200, 121, 5,
+	20, 113, 71, 35, 128, 13, 182, 94, 25, 226, 227, 199, 75, 27, 41, 245,
+	230, 224, 43, 225, 177, 26, 155, 150, 212, 142, 218, 115, 241, 73, 88, 105,
+	39, 114, 62, 255, 192, 201, 145, 214, 168, 158, 221, 148, 154, 122, 12, 84,
+	82, 163, 44, 139, 228, 236, 205, 242, 217, 11, 187, 146, 159, 64, 86, 239,
+	195, 42, 106, 198, 118, 112, 184, 172, 87, 2, 173, 117, 176, 229, 247, 253,
+	137, 185, 99, 164, 102, 147, 45, 66, 231, 52, 141, 211, 194, 206, 246, 238,
+	56, 110, 78, 248, 63, 240, 189, 93, 92, 51, 53, 183, 19, 171, 72, 50,
+	33, 104, 101, 69, 8, 252, 83, 120, 76, 135, 85, 54, 202, 125, 188, 213,
+	96, 235, 136, 208, 162, 129, 190, 132, 156, 38, 47, 1, 7, 254, 24, 4,
+	216, 131, 89, 21, 28, 133, 37, 153, 149, 80, 170, 68, 6, 169, 234, 151,
+}
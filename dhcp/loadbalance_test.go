@@ -0,0 +1,43 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestLoadBalance_Hash(t *testing.T) {
+	assertEqual(t, uint8(153), pearsonHash([]byte{0, 0, 0, 0, 0, 1}))
+	assertEqual(t, uint8(102), pearsonHash([]byte{0, 0, 0, 0, 0, 2}))
+
+	// client identifier is hashed instead of the hardware address
+	req := &dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0, 0, 0, 0, 0, 1}}
+	req.UpdateOption(dhcpv4.OptClientIdentifier([]byte{0, 0, 0, 0, 0, 2}))
+	assertEqual(t, uint8(102), loadBalanceHash(req))
+}
+
+func TestLoadBalance_Split(t *testing.T) {
+	primary := &LoadBalance{Role: LoadBalancePrimary, Split: 128}
+	secondary := &LoadBalance{Role: LoadBalanceSecondary, Split: 128}
+	served := 0
+	for i := 0; i < 1000; i++ {
+		req := &dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0, 0, 0, 0, byte(i >> 8), byte(i)}}
+		// every client is answered by exactly one server
+		assertTrue(t, primary.serves(req) != secondary.serves(req))
+		if primary.serves(req) {
+			served++
+		}
+	}
+	assertTrue(t, served > 400 && served < 600)
+
+	req := &dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{0, 0, 0, 0, 0, 1}}
+	assertTrue(t, !(&LoadBalance{Role: LoadBalancePrimary, Split: 0}).serves(req))
+	assertTrue(t, (&LoadBalance{Role: LoadBalancePrimary, Split: 256}).serves(req))
+	assertTrue(t, (&LoadBalance{Role: LoadBalancePrimary, Split: 0, PeerDown: true}).serves(req))
+
+	_, err := InitializeSubnet(&Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.3", LoadBalance: &LoadBalance{Role: "backup"}})
+	assertTrue(t, err != nil)
+	_, err = InitializeSubnet(&Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.3", LoadBalance: &LoadBalance{Role: LoadBalancePrimary, Split: 257}})
+	assertTrue(t, err != nil)
+}
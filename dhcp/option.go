@@ -0,0 +1,249 @@
+package dhcp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+)
+
+// Option value types. Lists are comma separated, routes are written as
+// "10.0.0.0/8-10.1.1.1".
+const (
+	OptionTypeString       = "string"
+	OptionTypeIP           = "ip"
+	OptionTypeIPList       = "ip-list"
+	OptionTypeUint8        = "uint8"
+	OptionTypeUint16       = "uint16"
+	OptionTypeUint32       = "uint32"
+	OptionTypeBool         = "bool"
+	OptionTypeHex          = "hex"
+	OptionTypeDomainSearch = "domain-search"
+	OptionTypeRoutes       = "routes"
+	OptionTypeBase64       = "base64"
+)
+
+var optionTypes = map[string]bool{
+	OptionTypeString:       true,
+	OptionTypeIP:           true,
+	OptionTypeIPList:       true,
+	OptionTypeUint8:        true,
+	OptionTypeUint16:       true,
+	OptionTypeUint32:       true,
+	OptionTypeBool:         true,
+	OptionTypeHex:          true,
+	OptionTypeDomainSearch: true,
+	OptionTypeRoutes:       true,
+	OptionTypeBase64:       true,
+}
+
+// OptionDefinition describes a well known option.
+type OptionDefinition struct {
+	Code uint8
+	Type string
+}
+
+// OptionNames is the registry of standard options accepted by name.
+var OptionNames = map[string]OptionDefinition{
+	"routers":                     {3, OptionTypeIPList},
+	"time-servers":                {4, OptionTypeIPList},
+	"domain-name-servers":         {6, OptionTypeIPList},
+	"log-servers":                 {7, OptionTypeIPList},
+	"host-name":                   {12, OptionTypeString},
+	"domain-name":                 {15, OptionTypeString},
+	"root-path":                   {17, OptionTypeString},
+	"ip-forwarding":               {19, OptionTypeBool},
+	"default-ip-ttl":              {23, OptionTypeUint8},
+	"interface-mtu":               {26, OptionTypeUint16},
+	"broadcast-address":           {28, OptionTypeIP},
+	"nis-domain":                  {40, OptionTypeString},
+	"nis-servers":                 {41, OptionTypeIPList},
+	"ntp-servers":                 {42, OptionTypeIPList},
+	"vendor-encapsulated-options": {43, OptionTypeHex},
+	"netbios-name-servers":        {44, OptionTypeIPList},
+	"netbios-node-type":           {46, OptionTypeUint8},
+	"renewal-time":                {58, OptionTypeUint32},
+	"rebinding-time":              {59, OptionTypeUint32},
+	"vendor-class-identifier":     {60, OptionTypeString},
+	"tftp-server-name":            {66, OptionTypeString},
+	"bootfile-name":               {67, OptionTypeString},
+	"smtp-servers":                {69, OptionTypeIPList},
+	"www-servers":                 {72, OptionTypeIPList},
+	"domain-search":               {119, OptionTypeDomainSearch},
+	"classless-static-routes":     {121, OptionTypeRoutes},
+	"tftp-server-address":         {150, OptionTypeIPList},
+	"wpad-url":                    {252, OptionTypeString},
+}
+
+func optionDefinitionByCode(code uint8) (OptionDefinition, bool) {
+	for _, def := range OptionNames {
+		if def.Code == code {
+			return def, true
+		}
+	}
+	return OptionDefinition{}, false
+}
+
+// ParseOption parses an option given by registry name or as "option-<code>".
+// The value is "<type>:<value>", the type may be omitted for registered options.
+func ParseOption(name string, value string) (Option, error) {
+	var (
+		def   OptionDefinition
+		known bool
+	)
+	if strings.HasPrefix(name, "option-") {
+		code, err := strconv.ParseUint(name[7:], 10, 8)
+		if err != nil || code < 1 || code > 254 {
+			return Option{}, fmt.Errorf("invalid option code %q", name[7:])
+		}
+		def, known = optionDefinitionByCode(uint8(code))
+		def.Code = uint8(code)
+	} else {
+		def, known = OptionNames[name]
+		if !known {
+			return Option{}, fmt.Errorf("unknown option %q", name)
+		}
+	}
+	opt := Option{ID: def.Code, Type: def.Type, Value: value}
+	typeVal := strings.SplitN(value, ":", 2)
+	if len(typeVal) == 2 && optionTypes[typeVal[0]] {
+		if known && typeVal[0] != def.Type {
+			return Option{}, fmt.Errorf("option %s must be %s, not %s", name, def.Type, typeVal[0])
+		}
+		opt.Type = typeVal[0]
+		opt.Value = typeVal[1]
+	} else if !known {
+		return Option{}, fmt.Errorf("type is required for option %s", name)
+	}
+	return opt, opt.Validate()
+}
+
+type Option struct {
+	ID    uint8  `json:"id"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Encode returns the option value in wire format according to its type.
+func (o Option) Encode() ([]byte, error) {
+	switch o.Type {
+	case OptionTypeString:
+		return []byte(o.Value), nil
+	case OptionTypeIP:
+		return parseIPs(o.Value, 1)
+	case OptionTypeIPList:
+		return parseIPs(o.Value, 0)
+	case OptionTypeUint8:
+		n, err := strconv.ParseUint(o.Value, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		return []byte{uint8(n)}, nil
+	case OptionTypeUint16:
+		n, err := strconv.ParseUint(o.Value, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, 2)
+		binary.BigEndian.PutUint16(data, uint16(n))
+		return data, nil
+	case OptionTypeUint32:
+		n, err := strconv.ParseUint(o.Value, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(n))
+		return data, nil
+	case OptionTypeBool:
+		b, err := strconv.ParseBool(o.Value)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case OptionTypeHex:
+		return hex.DecodeString(strings.ReplaceAll(o.Value, ":", ""))
+	case OptionTypeDomainSearch:
+		labels := &rfc1035label.Labels{Labels: splitList(o.Value)}
+		if len(labels.Labels) == 0 {
+			return nil, fmt.Errorf("empty domain search list")
+		}
+		return labels.ToBytes(), nil
+	case OptionTypeRoutes:
+		return parseRoutes(o.Value)
+	case OptionTypeBase64:
+		return base64.StdEncoding.DecodeString(o.Value)
+	default:
+		return nil, fmt.Errorf("unknown option type %q", o.Type)
+	}
+}
+
+// Validate checks that the option value can be encoded.
+func (o Option) Validate() error {
+	_, err := o.Encode()
+	if err != nil {
+		return fmt.Errorf("invalid option %d %s:%s: %s", o.ID, o.Type, o.Value, err)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseIPs encodes comma separated ipv4 addresses, exactly count of them unless count is 0.
+func parseIPs(s string, count int) ([]byte, error) {
+	items := splitList(s)
+	if len(items) == 0 || (count != 0 && len(items) != count) {
+		return nil, fmt.Errorf("invalid number of addresses in %q", s)
+	}
+	data := make([]byte, 0, len(items)*net.IPv4len)
+	for _, item := range items {
+		ip := net.ParseIP(item).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ipv4 %q", item)
+		}
+		data = append(data, ip...)
+	}
+	return data, nil
+}
+
+// parseRoutes encodes classless static routes (RFC 3442) like "10.0.0.0/8-10.1.1.1".
+func parseRoutes(s string) ([]byte, error) {
+	routes := make(dhcpv4.Routes, 0)
+	for _, item := range splitList(s) {
+		destRouter := strings.Split(item, "-")
+		if len(destRouter) != 2 {
+			return nil, fmt.Errorf("invalid route %q", item)
+		}
+		_, dest, err := net.ParseCIDR(strings.TrimSpace(destRouter[0]))
+		if err != nil || dest.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid route destination %q", destRouter[0])
+		}
+		router := net.ParseIP(strings.TrimSpace(destRouter[1])).To4()
+		if router == nil {
+			return nil, fmt.Errorf("invalid route gateway %q", destRouter[1])
+		}
+		routes = append(routes, &dhcpv4.Route{Dest: dest, Router: router})
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("empty route list")
+	}
+	return routes.ToBytes(), nil
+}
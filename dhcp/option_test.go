@@ -0,0 +1,74 @@
+package dhcp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOption_Encode(t *testing.T) {
+	for _, tc := range []struct {
+		opt      Option
+		expected []byte
+	}{
+		{Option{Type: "string", Value: "boot.pxe"}, []byte("boot.pxe")},
+		{Option{Type: "ip", Value: "10.1.1.1"}, []byte{10, 1, 1, 1}},
+		{Option{Type: "ip-list", Value: "10.1.1.1, 10.1.1.2"}, []byte{10, 1, 1, 1, 10, 1, 1, 2}},
+		{Option{Type: "uint8", Value: "64"}, []byte{64}},
+		{Option{Type: "uint16", Value: "1500"}, []byte{5, 220}},
+		{Option{Type: "uint32", Value: "3600"}, []byte{0, 0, 14, 16}},
+		{Option{Type: "bool", Value: "true"}, []byte{1}},
+		{Option{Type: "hex", Value: "01:02:ff"}, []byte{1, 2, 255}},
+		{Option{Type: "domain-search", Value: "eng.example.com,example.com"}, []byte("\x03eng\x07example\x03com\x00\x07example\x03com\x00")},
+		{Option{Type: "routes", Value: "10.0.0.0/8-10.1.1.1,0.0.0.0/0-10.1.1.254"}, []byte{8, 10, 10, 1, 1, 1, 0, 10, 1, 1, 254}},
+		{Option{Type: "base64", Value: "AQID"}, []byte{1, 2, 3}},
+	} {
+		data, err := tc.opt.Encode()
+		assertNoError(t, err)
+		if !bytes.Equal(tc.expected, data) {
+			t.Errorf("%v: %v != %v", tc.opt, tc.expected, data)
+		}
+	}
+	for _, opt := range []Option{
+		{Type: "ip", Value: "10.1.1.1,10.1.1.2"},
+		{Type: "ip-list", Value: "10.1.1"},
+		{Type: "uint8", Value: "256"},
+		{Type: "bool", Value: "maybe"},
+		{Type: "hex", Value: "0g"},
+		{Type: "routes", Value: "10.0.0.0/8"},
+		{Type: "base64", Value: "!"},
+		{Type: "unknown", Value: "1"},
+	} {
+		assertTrue(t, opt.Validate() != nil)
+	}
+}
+
+func TestParseOption(t *testing.T) {
+	opt, err := ParseOption("bootfile-name", "boot.pxe")
+	assertNoError(t, err)
+	assertEqual(t, Option{ID: 67, Type: "string", Value: "boot.pxe"}, opt)
+	opt, err = ParseOption("option-67", "string:boot.pxe")
+	assertNoError(t, err)
+	assertEqual(t, Option{ID: 67, Type: "string", Value: "boot.pxe"}, opt)
+	opt, err = ParseOption("ntp-servers", "10.1.1.1,10.1.1.2")
+	assertNoError(t, err)
+	assertEqual(t, Option{ID: 42, Type: "ip-list", Value: "10.1.1.1,10.1.1.2"}, opt)
+	opt, err = ParseOption("option-150", "10.1.1.1")
+	assertNoError(t, err)
+	assertEqual(t, Option{ID: 150, Type: "ip-list", Value: "10.1.1.1"}, opt)
+	opt, err = ParseOption("option-224", "hex:01:02")
+	assertNoError(t, err)
+	assertEqual(t, Option{ID: 224, Type: "hex", Value: "01:02"}, opt)
+
+	_, err = ParseOption("option-224", "01:02")
+	assertTrue(t, err != nil)
+	_, err = ParseOption("option-255", "string:x")
+	assertTrue(t, err != nil)
+	_, err = ParseOption("option-0", "string:x")
+	assertTrue(t, err != nil)
+	_, err = ParseOption("ntp-servers", "string:x")
+	assertTrue(t, err != nil)
+	_, err = ParseOption("ntp-servers", "x")
+	assertTrue(t, err != nil)
+	_, err = ParseOption("no-such-option", "x")
+	assertTrue(t, err != nil)
+}
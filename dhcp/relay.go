@@ -0,0 +1,93 @@
+package dhcp
+
+import (
+	"fmt"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// RelayInfo holds the relay agent information sub-options (RFC 3046) identifying
+// the switch port of the client.
+type RelayInfo struct {
+	CircuitID string
+	RemoteID  string
+}
+
+func GetRelayInfo(req *dhcpv4.DHCPv4) RelayInfo {
+	info := RelayInfo{}
+	rai := req.RelayAgentInfo()
+	if rai == nil {
+		return info
+	}
+	info.CircuitID = string(rai.Get(dhcpv4.AgentCircuitIDSubOption))
+	info.RemoteID = string(rai.Get(dhcpv4.AgentRemoteIDSubOption))
+	return info
+}
+
+// relayKey identifies hosts reserved by circuit-id and/or remote-id. Circuit-id
+// alone is qualified by the address of the relay agent, since other relay
+// agents may use the same circuit-id.
+func relayKey(relay string, circuitID string, remoteID string) string {
+	if remoteID != "" {
+		relay = ""
+	}
+	return "relay:" + relay + "/" + circuitID + "|" + remoteID
+}
+
+// hostKeys returns the keys of hosts which may match req, most specific first.
+func hostKeys(req *dhcpv4.DHCPv4) []string {
+	keys := []string{req.ClientHWAddr.String()}
+	info := GetRelayInfo(req)
+	if info.CircuitID != "" && info.RemoteID != "" {
+		keys = append(keys, relayKey("", info.CircuitID, info.RemoteID))
+	}
+	if info.CircuitID != "" && req.GatewayIPAddr.To4() != nil && !req.GatewayIPAddr.IsUnspecified() {
+		keys = append(keys, relayKey(req.GatewayIPAddr.To4().String(), info.CircuitID, ""))
+	}
+	if info.RemoteID != "" {
+		keys = append(keys, relayKey("", "", info.RemoteID))
+	}
+	return keys
+}
+
+// checkRelayRules returns an error if a client may match the relay rules of
+// both subnets, which would leave the choice to chance.
+func (s *Subnet) checkRelayRules(other *Subnet) error {
+	for _, id := range s.CircuitIDs {
+		for _, otherID := range other.CircuitIDs {
+			if id == otherID {
+				return fmt.Errorf("circuit-id %q is already used by subnet %s", id, other.Subnet)
+			}
+		}
+	}
+	for _, id := range s.RemoteIDs {
+		for _, otherID := range other.RemoteIDs {
+			if id == otherID {
+				return fmt.Errorf("remote-id %q is already used by subnet %s", id, other.Subnet)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesCircuitID reports whether the subnet is selected for clients behind
+// the relay port with circuitID.
+func (s *Subnet) matchesCircuitID(circuitID string) bool {
+	for _, id := range s.CircuitIDs {
+		if circuitID != "" && id == circuitID {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesRemoteID reports whether the subnet is selected for clients behind
+// the relay agent with remoteID.
+func (s *Subnet) matchesRemoteID(remoteID string) bool {
+	for _, id := range s.RemoteIDs {
+		if remoteID != "" && id == remoteID {
+			return true
+		}
+	}
+	return false
+}
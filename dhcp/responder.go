@@ -19,18 +19,23 @@ type Responder interface {
 	Close()
 	SendUnicast(resp *dhcpv4.DHCPv4, peer net.Addr) error
 	SendBroadcast(resp *dhcpv4.DHCPv4) error
+	// SendHardwareUnicast sends resp in a frame addressed to chaddr and yiaddr.
+	SendHardwareUnicast(resp *dhcpv4.DHCPv4) error
 }
 
+// SocketResponder sends replies from raw socket. Listeners answer clients
+// concurrently, so the layers below are templates copied for every frame.
 type SocketResponder struct {
 	fd    int
 	layer syscall.SockaddrLinklayer
 	eth   layers.Ethernet
+	dot1q *layers.Dot1Q
 	ip    layers.IPv4
 	udp   layers.UDP
-	buf   gopacket.SerializeBuffer
 	opts  gopacket.SerializeOptions
 
 	ifname string
+	srcIP  net.IP
 }
 
 type DefaultResponderFactory struct{}
@@ -50,9 +55,15 @@ func (r *DefaultResponderFactory) NewResponder(listen *Listen) (Responder, error
 	if err != nil {
 		return nil, fmt.Errorf("cannot set option for socket: %v", err)
 	}
+	responder := newSocketResponder(listen, iface)
+	responder.fd = fd
+	return responder, nil
+}
+
+func newSocketResponder(listen *Listen, iface *net.Interface) *SocketResponder {
 	responder := &SocketResponder{
 		ifname: listen.Interface,
-		fd:     fd,
+		srcIP:  net.ParseIP(listen.Laddr).To4(),
 		layer: syscall.SockaddrLinklayer{
 			Protocol: 0,
 			Ifindex:  iface.Index,
@@ -76,13 +87,15 @@ func (r *DefaultResponderFactory) NewResponder(listen *Listen) (Responder, error
 			ComputeChecksums: true,
 			FixLengths:       true,
 		},
-		buf: gopacket.NewSerializeBuffer(),
 	}
-	err = responder.udp.SetNetworkLayerForChecksum(&responder.ip)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't set network layer: %v", err)
+	if listen.VLAN != 0 {
+		responder.eth.EthernetType = layers.EthernetTypeDot1Q
+		responder.dot1q = &layers.Dot1Q{
+			VLANIdentifier: listen.VLAN,
+			Type:           layers.EthernetTypeIPv4,
+		}
 	}
-	return responder, nil
+	return responder
 }
 
 func (r *SocketResponder) SendUnicast(resp *dhcpv4.DHCPv4, target net.Addr) error {
@@ -96,25 +109,61 @@ func (r *SocketResponder) SendUnicast(resp *dhcpv4.DHCPv4, target net.Addr) erro
 }
 
 func (r *SocketResponder) SendBroadcast(resp *dhcpv4.DHCPv4) error {
-	r.eth.DstMAC = resp.ClientHWAddr
-	r.ip.SrcIP = resp.ServerIPAddr
-	r.ip.DstIP = resp.YourIPAddr
+	data, err := r.frame(resp, layers.EthernetBroadcast, net.IPv4bcast)
+	if err != nil {
+		return err
+	}
+	return r.send(resp, data)
+}
+
+func (r *SocketResponder) SendHardwareUnicast(resp *dhcpv4.DHCPv4) error {
+	if resp.YourIPAddr == nil || resp.YourIPAddr.Equal(net.IPv4zero) {
+		// there is no address to send to, e.g. in NAK
+		return r.SendBroadcast(resp)
+	}
+	data, err := r.frame(resp, resp.ClientHWAddr, resp.YourIPAddr)
+	if err != nil {
+		return err
+	}
+	return r.send(resp, data)
+}
+
+// frame serializes resp into ethernet frame, tagged if the listener has VLAN.
+func (r *SocketResponder) frame(resp *dhcpv4.DHCPv4, dstMAC net.HardwareAddr, dstIP net.IP) ([]byte, error) {
+	eth := r.eth
+	eth.DstMAC = dstMAC
+	ip := r.ip
+	ip.SrcIP = r.srcIP
+	if ip.SrcIP == nil {
+		ip.SrcIP = resp.ServerIPAddr
+	}
+	ip.DstIP = dstIP
+	udp := r.udp
+	err := udp.SetNetworkLayerForChecksum(&ip)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set network layer: %v", err)
+	}
 
 	packet := gopacket.NewPacket(resp.ToBytes(), layers.LayerTypeDHCPv4, gopacket.NoCopy)
 	dhcpLayer := packet.Layer(layers.LayerTypeDHCPv4)
 	dhcp, ok := dhcpLayer.(gopacket.SerializableLayer)
 	if !ok {
-		return fmt.Errorf("layer %q is not serializable", dhcpLayer.LayerType().String())
+		return nil, fmt.Errorf("layer %q is not serializable", dhcpLayer.LayerType().String())
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if r.dot1q != nil {
+		dot1q := *r.dot1q
+		err = gopacket.SerializeLayers(buf, r.opts, &eth, &dot1q, &ip, &udp, dhcp)
+	} else {
+		err = gopacket.SerializeLayers(buf, r.opts, &eth, &ip, &udp, dhcp)
 	}
-	err := gopacket.SerializeLayers(r.buf, r.opts, &r.eth, &r.ip, &r.udp, dhcp)
 	if err != nil {
-		return fmt.Errorf("cannot serialize layer: %v", err)
+		return nil, fmt.Errorf("cannot serialize layer: %v", err)
 	}
-	data := r.buf.Bytes()
-
-	var hwAddr [8]byte
-	copy(hwAddr[0:6], resp.ClientHWAddr[0:6])
+	return buf.Bytes(), nil
+}
 
+func (r *SocketResponder) send(resp *dhcpv4.DHCPv4, data []byte) error {
 	log.Printf("%s -> %s %s %s %v", r.ifname, resp.ClientHWAddr, resp.MessageType(), resp.YourIPAddr, resp.Options)
 	return syscall.Sendto(r.fd, data, 0, &r.layer)
 }
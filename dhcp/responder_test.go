@@ -0,0 +1,122 @@
+package dhcp
+
+import (
+	"fmt"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func newTestResponder(vlan uint16) *SocketResponder {
+	iface := &net.Interface{Index: 1, HardwareAddr: net.HardwareAddr{0, 0, 0, 0, 0xff, 1}}
+	return newSocketResponder(&Listen{Interface: "eth0", Laddr: "192.168.1.1", VLAN: vlan}, iface)
+}
+
+func newTestReply(t *testing.T, msgType dhcpv4.MessageType, yiaddr net.IP) *dhcpv4.DHCPv4 {
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 1})
+	assertNoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(msgType), dhcpv4.WithYourIP(yiaddr))
+	assertNoError(t, err)
+	return resp
+}
+
+func TestSocketResponder_Broadcast(t *testing.T) {
+	r := newTestResponder(0)
+	data, err := r.frame(newTestReply(t, dhcpv4.MessageTypeOffer, net.IPv4(192, 168, 1, 10)), layers.EthernetBroadcast, net.IPv4bcast)
+	assertNoError(t, err)
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	assertEqual(t, layers.EthernetBroadcast.String(), eth.DstMAC.String())
+	assertEqual(t, layers.EthernetTypeIPv4, eth.EthernetType)
+	ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	assertEqual(t, "255.255.255.255", ip.DstIP.String())
+	assertEqual(t, "192.168.1.1", ip.SrcIP.String())
+	udp := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	assertEqual(t, layers.UDPPort(dhcpv4.ClientPort), udp.DstPort)
+	assertTrue(t, packet.Layer(layers.LayerTypeDHCPv4) != nil)
+}
+
+func TestSocketResponder_Nak(t *testing.T) {
+	r := newTestResponder(0)
+	resp := newTestReply(t, dhcpv4.MessageTypeNak, net.IPv4zero)
+	assertTrue(t, resp.ServerIPAddr.Equal(net.IPv4zero))
+	data, err := r.frame(resp, layers.EthernetBroadcast, net.IPv4bcast)
+	assertNoError(t, err)
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	// source address comes from the listener even if siaddr is not set
+	assertEqual(t, "192.168.1.1", ip.SrcIP.String())
+	assertEqual(t, "255.255.255.255", ip.DstIP.String())
+}
+
+func TestSocketResponder_VLAN(t *testing.T) {
+	r := newTestResponder(100)
+	resp := newTestReply(t, dhcpv4.MessageTypeAck, net.IPv4(192, 168, 1, 10))
+	data, err := r.frame(resp, resp.ClientHWAddr, resp.YourIPAddr)
+	assertNoError(t, err)
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	assertEqual(t, layers.EthernetTypeDot1Q, eth.EthernetType)
+	assertEqual(t, "00:00:00:00:00:01", eth.DstMAC.String())
+	dot1q, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	assertTrue(t, ok)
+	if ok {
+		assertEqual(t, uint16(100), dot1q.VLANIdentifier)
+		assertEqual(t, layers.EthernetTypeIPv4, dot1q.Type)
+	}
+	ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	assertEqual(t, "192.168.1.10", ip.DstIP.String())
+	assertTrue(t, packet.Layer(layers.LayerTypeDHCPv4) != nil)
+}
+
+func TestSocketResponder_Concurrent(t *testing.T) {
+	r := newTestResponder(100)
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mac := net.HardwareAddr{0, 0, 0, 0, 1, byte(i)}
+			yiaddr := net.IPv4(192, 168, 1, byte(10+i))
+			req, err := dhcpv4.NewDiscovery(mac)
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck), dhcpv4.WithYourIP(yiaddr))
+			if err != nil {
+				errs <- err
+				return
+			}
+			for n := 0; n < 20; n++ {
+				data, err := r.frame(resp, resp.ClientHWAddr, resp.YourIPAddr)
+				if err != nil {
+					errs <- err
+					return
+				}
+				packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+				eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+				ip, ok2 := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				reply, ok3 := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+				if !ok || !ok2 || !ok3 {
+					errs <- fmt.Errorf("corrupted frame for %s", mac)
+					return
+				}
+				if eth.DstMAC.String() != mac.String() || !ip.DstIP.Equal(yiaddr) || reply.ClientHWAddr.String() != mac.String() {
+					errs <- fmt.Errorf("frame for %s %s sent to %s %s", mac, yiaddr, eth.DstMAC, ip.DstIP)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -13,26 +14,39 @@ type Listen struct {
 	Interface string `json:"interface,omitempty"`
 	Subnet    string `json:"subnet"`
 	Laddr     string `json:"laddr"`
-}
-
-type Option struct {
-	ID    uint8  `json:"id"`
-	Type  string `json:"type"`
-	Value string `json:"value"`
+	// VLAN tags raw ethernet replies with 802.1Q header.
+	VLAN uint16 `json:"vlan,omitempty"`
 }
 
 type Server struct {
+	// mu guards listeners, subnets and hosts, which are reconfigured while
+	// the listeners serve clients.
+	mu                sync.RWMutex
 	listeners         []*Listener
 	responders        []*Responder
 	subnets           map[string]*Subnet
+	hosts             map[string]*Host
 	dhcpServerFactory DHCPv4ServerFactory
 	responderFactory  ResponderFactory
+	leaseHandler      func(*Lease) error
+	claimLease        func(*Lease, time.Time) error
+	failover          *Failover
 }
 
+// maxClaimAttempts limits how many addresses are tried for DISCOVER when
+// other servers take them.
+const maxClaimAttempts = 4
+
 type ServerConfig struct {
 	DHCPv4ServerFactory DHCPv4ServerFactory
 	ResponderFactory    ResponderFactory
-	HandleLease         func(*Lease) error
+	// HandleLease persists leases changed by the server. It returns
+	// ErrLeaseTaken if a bound address is held by another server.
+	HandleLease func(*Lease) error
+	// ClaimLease reserves the address of an offered lease until the expiry in
+	// storage shared with other servers. It returns ErrLeaseTaken if another
+	// server holds the address.
+	ClaimLease func(*Lease, time.Time) error
 }
 
 func GetDefaultServerConfig(leaseHandler func(*Lease) error) ServerConfig {
@@ -47,34 +61,214 @@ func NewServer(config ServerConfig) *Server {
 	return &Server{
 		listeners:         make([]*Listener, 0),
 		subnets:           make(map[string]*Subnet),
+		hosts:             make(map[string]*Host),
 		dhcpServerFactory: config.DHCPv4ServerFactory,
 		responderFactory:  config.ResponderFactory,
+		leaseHandler:      config.HandleLease,
+		claimLease:        config.ClaimLease,
+	}
+}
+
+// serverID returns the server identifier (option 54) for replies in subnet
+// received by listen.
+func serverID(subnet *Subnet, listen *Listen) net.IP {
+	if subnet != nil && subnet.ServerID != "" {
+		return net.ParseIP(subnet.ServerID).To4()
+	}
+	return net.ParseIP(listen.Laddr).To4()
+}
+
+// isRelayed reports whether msg came through a relay agent.
+func isRelayed(msg *dhcpv4.DHCPv4) bool {
+	return msg.GatewayIPAddr != nil && !msg.GatewayIPAddr.Equal(net.IPv4zero)
+}
+
+// selectionAddress returns the address selecting client subnet requested by
+// subnet selection option (RFC 3011) or link selection sub-option (RFC 3527).
+func selectionAddress(req *dhcpv4.DHCPv4) net.IP {
+	if ip := dhcpv4.GetIP(dhcpv4.OptionSubnetSelection, req.Options); ip != nil {
+		return ip
+	}
+	if rai := req.RelayAgentInfo(); rai != nil {
+		if ip := dhcpv4.GetIP(dhcpv4.LinkSelectionSubOption, rai.Options); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// findSubnet selects the subnet of the client by subnet/link selection, relay
+// agent port rules, relay agent address or the subnet of the listener, in that order.
+func (s *Server) findSubnet(req *dhcpv4.DHCPv4, listen *Listen) *Subnet {
+	if ip := selectionAddress(req); ip != nil {
+		return s.subnetForIP(ip)
+	}
+	if sn := s.subnetForRelayInfo(req); sn != nil {
+		return sn
+	}
+	if isRelayed(req) {
+		return s.subnetForIP(req.GatewayIPAddr)
+	}
+	return s.subnets[listen.Subnet]
+}
+
+// checkRequest validates the address requested by a client in REQUEST (RFC 2131 4.3.2).
+// It returns the reason to send NAK, or an error if the request must be ignored.
+func (s *Server) checkRequest(req *dhcpv4.DHCPv4, subnet *Subnet) (string, error) {
+	ip := req.RequestedIPAddress()
+	if ip == nil {
+		// RENEWING or REBINDING client
+		ip = req.ClientIPAddr
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return "", fmt.Errorf("request from %s without address", req.ClientHWAddr)
+	}
+	if subnet == nil {
+		return fmt.Sprintf("no subnet for %s", ip), nil
+	}
+	if !subnet.Contains(ip) {
+		return fmt.Sprintf("%s is on the wrong network", ip), nil
+	}
+	err := subnet.checkLease(clientKeyOf(req), ip)
+	if errors.Is(err, ErrUnknownClient) && req.ServerIdentifier() == nil {
+		// server must remain silent if it has no record of the client
+		return "", err
+	}
+	if err != nil {
+		return err.Error(), nil
+	}
+	return "", nil
+}
+
+func (s *Server) newNak(req *dhcpv4.DHCPv4, subnet *Subnet, listen *Listen, reason string) (*dhcpv4.DHCPv4, error) {
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID(subnet, listen))),
+		dhcpv4.WithOption(dhcpv4.OptMessage(reason)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if isRelayed(resp) {
+		// relay agent must broadcast NAK to the client
+		resp.SetBroadcast()
+	}
+	log.Printf("NAK %s: %s", req.ClientHWAddr, reason)
+	return resp, nil
+}
+
+// updateOptions sets configured options, router and DNS servers in resp.
+// Routers and DNS servers configured as options take precedence over the
+// gateway and dns settings.
+func updateOptions(resp *dhcpv4.DHCPv4, gateway string, dns []string, options []Option) {
+	configured := make(map[uint8]bool, len(options))
+	for _, opt := range options {
+		configured[opt.ID] = true
+		if opt.ID == dhcpv4.OptionClientIdentifier.Code() {
+			// client identifier is echoed from the request (RFC 6842)
+			continue
+		}
+		value, err := opt.Encode()
+		if err != nil {
+			log.Printf("skipping option %d: %s", opt.ID, err)
+			continue
+		}
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(opt.ID), value))
+	}
+	if gw := net.ParseIP(gateway).To4(); gw != nil && !configured[dhcpv4.OptionRouter.Code()] {
+		resp.UpdateOption(dhcpv4.OptRouter(gw))
+	}
+	if len(dns) == 0 || configured[dhcpv4.OptionDomainNameServer.Code()] {
+		return
+	}
+	dnsServers := make([]net.IP, 0)
+	for _, dns := range dns {
+		dnsServers = append(dnsServers, net.ParseIP(dns).To4())
+	}
+	resp.UpdateOption(dhcpv4.OptDNS(dnsServers...))
+}
+
+// getInform builds ACK for INFORM from a client with manually configured address.
+// It carries configuration only, so neither yiaddr nor lease time are set (RFC 2131 4.3.5).
+func (s *Server) getInform(req *dhcpv4.DHCPv4, listen *Listen) (*dhcpv4.DHCPv4, error) {
+	if req.ClientIPAddr == nil || req.ClientIPAddr.Equal(net.IPv4zero) {
+		return nil, fmt.Errorf("inform from %s without client address", req.ClientHWAddr)
+	}
+	s.mu.RLock()
+	subnet := s.subnetForIP(req.ClientIPAddr)
+	s.mu.RUnlock()
+	if subnet == nil {
+		return nil, fmt.Errorf("subnet for %s not found", req.ClientIPAddr)
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		return nil, err
 	}
+	resp.ClientIPAddr = req.ClientIPAddr
+	updateOptions(resp, subnet.Gateway, subnet.DNS, subnet.Options)
+	resp.UpdateOption(dhcpv4.OptSubnetMask(subnet.ipNet.Mask))
+	resp.UpdateOption(dhcpv4.OptServerIdentifier(serverID(subnet, listen)))
+	return resp, nil
 }
 
 func (s *Server) getLease(req *dhcpv4.DHCPv4, listen *Listen) (*dhcpv4.DHCPv4, error) {
+	if req.MessageType() == dhcpv4.MessageTypeInform {
+		return s.getInform(req, listen)
+	}
+	s.mu.RLock()
+	subnet := s.findSubnet(req, listen)
+	failover := s.failover
+	s.mu.RUnlock()
+	if failover != nil && !failover.serves(req) {
+		return nil, fmt.Errorf("%s is served by the failover peer", req.ClientHWAddr)
+	}
+	if subnet != nil && subnet.LoadBalance != nil && isLoadBalanced(req) && !subnet.LoadBalance.serves(req) {
+		return nil, fmt.Errorf("%s is served by the load balancing peer", req.ClientHWAddr)
+	}
+	if req.MessageType() == dhcpv4.MessageTypeRequest {
+		id := req.ServerIdentifier()
+		if id != nil && !id.Equal(serverID(subnet, listen)) {
+			return nil, fmt.Errorf("%s selected another server %s", req.ClientHWAddr, id)
+		}
+		reason, err := s.checkRequest(req, subnet)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			return s.newNak(req, subnet, listen, reason)
+		}
+	}
+	if subnet == nil {
+		return nil, fmt.Errorf("subnet for %s not found", req.ClientHWAddr)
+	}
+	isRequest := req.MessageType() == dhcpv4.MessageTypeRequest
 	var lease *Lease
-	subnet, ok := s.subnets[listen.Subnet]
-	if ok {
-		lease = subnet.GetLeaseForMAC(req)
+	for attempt := 1; ; attempt++ {
+		var before *Lease
+		lease, before = subnet.leaseFor(req, isRequest)
 		if lease == nil {
-			return nil, errors.New("empty lease")
-		}
-	} else {
-		for _, s := range s.subnets {
-			if s.Contains(req.GatewayIPAddr) {
-				log.Printf("found subnet: %v", s)
-				lease = s.GetLeaseForMAC(req)
-				break
+			return nil, fmt.Errorf("no free addresses in %s", subnet.Subnet)
+		}
+		err := s.storeLease(subnet, lease)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLeaseTaken) {
+			// the client gets no reply, so the lease must not stay bound
+			if before != nil {
+				subnet.restoreLease(before)
 			} else {
-				log.Printf("%s not in %s (%s)", req.GatewayIPAddr.String(), s.Subnet, s.ipNet)
+				subnet.dropLease(lease)
 			}
+			return nil, err
+		}
+		subnet.dropLease(lease)
+		if isRequest {
+			return s.newNak(req, subnet, listen, err.Error())
+		}
+		if attempt == maxClaimAttempts {
+			return nil, err
 		}
-	}
-
-	if lease == nil {
-		//TODO: send NAK
-		return nil, errors.New("NAK not implemented")
 	}
 	log.Printf("got lease %v", lease)
 
@@ -84,91 +278,372 @@ func (s *Server) getLease(req *dhcpv4.DHCPv4, listen *Listen) (*dhcpv4.DHCPv4, e
 	}
 
 	resp.YourIPAddr = net.ParseIP(lease.IP).To4()
-	resp.GatewayIPAddr = net.ParseIP(lease.Gateway).To4()
-	for _, opt := range lease.Options {
-		var value dhcpv4.OptionValue
-		code := opt.ID
-		switch opt.Type {
-		case "string":
-			value = dhcpv4.String(opt.Value)
-		default:
-			log.Printf("invalid option value type in subnet: %v", subnet)
-		}
-		resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.GenericOptionCode(code), Value: value})
-	}
+	updateOptions(resp, lease.Gateway, lease.DNS, lease.Options)
 	resp.UpdateOption(dhcpv4.OptSubnetMask(net.IPMask(net.ParseIP(lease.NetMask).To4())))
 	resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(time.Duration(lease.LeaseTime) * time.Second))
-	resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.GenericOptionCode(3), Value: dhcpv4.IP{resp.GatewayIPAddr[0], resp.GatewayIPAddr[1], resp.GatewayIPAddr[2], resp.GatewayIPAddr[3]}})
 	//resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.GenericOptionCode(28), Value: dhcpv4.IP{10, 12, 1, 255}})
-	dnsServers := make([]net.IP, 0)
-	for _, dns := range lease.DNS {
-		dnsServers = append(dnsServers, net.ParseIP(dns).To4())
+
+	resp.UpdateOption(dhcpv4.OptServerIdentifier(serverID(subnet, listen)))
+	return resp, nil
+}
+
+// storeLease persists the bound lease, or claims the address of the offered
+// one if the server shares leases with other servers.
+func (s *Server) storeLease(subnet *Subnet, lease *Lease) error {
+	if lease.State != LeaseStateOffered {
+		return s.persistLease(lease)
 	}
-	resp.UpdateOption(dhcpv4.OptDNS(dnsServers...))
+	if s.claimLease == nil {
+		return nil
+	}
+	return s.claimLease(lease, subnet.expiry(lease))
+}
+
+func (s *Server) handleNotification(req *dhcpv4.DHCPv4, listen *Listen) error {
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease:
+		return s.releaseLease(req, listen)
+	case dhcpv4.MessageTypeDecline:
+		return s.declineLease(req, listen)
+	default:
+		return fmt.Errorf("unexpected notification %s", req.MessageType())
+	}
+}
 
-	//TODO: option 54 server id
-	resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.GenericOptionCode(54), Value: dhcpv4.IP{resp.GatewayIPAddr[0], resp.GatewayIPAddr[1], resp.GatewayIPAddr[2], resp.GatewayIPAddr[3]}})
+func (s *Server) releaseLease(req *dhcpv4.DHCPv4, listen *Listen) error {
+	s.mu.RLock()
+	subnet := s.subnetForIP(req.ClientIPAddr)
+	s.mu.RUnlock()
+	if subnet == nil {
+		return fmt.Errorf("subnet for released address %s not found", req.ClientIPAddr)
+	}
+	id := req.ServerIdentifier()
+	if id == nil || !id.Equal(serverID(subnet, listen)) {
+		return fmt.Errorf("release from %s for another server %s", req.ClientHWAddr, id)
+	}
+	lease, err := subnet.releaseLease(clientKeyOf(req), req.ClientIPAddr)
+	if err != nil {
+		return err
+	}
+	lease = subnet.copyLease(lease)
+	log.Printf("released lease %v", lease)
+	return s.persistLease(lease)
+}
 
-	if resp.MessageType() == dhcpv4.MessageTypeAck {
-		err = s.HandleLease(lease)
-		if err != nil {
-			return nil, err
+func (s *Server) declineLease(req *dhcpv4.DHCPv4, listen *Listen) error {
+	ip := req.RequestedIPAddress()
+	if ip == nil {
+		return fmt.Errorf("decline from %s without requested address", req.ClientHWAddr)
+	}
+	s.mu.RLock()
+	subnet := s.subnetForIP(ip)
+	s.mu.RUnlock()
+	if subnet == nil {
+		return fmt.Errorf("subnet for declined address %s not found", ip)
+	}
+	id := req.ServerIdentifier()
+	if id == nil || !id.Equal(serverID(subnet, listen)) {
+		return fmt.Errorf("decline from %s for another server %s", req.ClientHWAddr, id)
+	}
+	lease, err := subnet.declineLease(clientKeyOf(req), ip)
+	if err != nil {
+		return err
+	}
+	lease = subnet.copyLease(lease)
+	log.Printf("address %s declined by %s, quarantined for %ds", lease.IP, lease.MAC, subnet.DeclineHoldTime)
+	return s.persistLease(lease)
+}
+
+// persistLease passes lease to the lease handler from ServerConfig, if any.
+func (s *Server) persistLease(lease *Lease) error {
+	err := s.persistPeerLease(lease)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	failover := s.failover
+	s.mu.RUnlock()
+	if failover != nil {
+		failover.update(lease)
+	}
+	return nil
+}
+
+// persistPeerLease passes lease to the lease handler without sending it to
+// the failover peer, which the lease came from.
+func (s *Server) persistPeerLease(lease *Lease) error {
+	if s.leaseHandler == nil {
+		return nil
+	}
+	return s.leaseHandler(lease)
+}
+
+// subnetList returns the served subnets.
+func (s *Server) subnetList() []*Subnet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subnets := make([]*Subnet, 0, len(s.subnets))
+	for _, subnet := range s.subnets {
+		subnets = append(subnets, subnet)
+	}
+	return subnets
+}
+
+// subnetForRelayInfo selects the subnet by relay agent circuit-id or remote-id,
+// either of the reserved host or of the subnet rules. Circuit-id rules go
+// before remote-id ones; a circuit-id or remote-id selects one subnet at most,
+// see HandleSubnet.
+func (s *Server) subnetForRelayInfo(req *dhcpv4.DHCPv4) *Subnet {
+	info := GetRelayInfo(req)
+	if info.CircuitID == "" && info.RemoteID == "" {
+		return nil
+	}
+	for _, key := range hostKeys(req)[1:] {
+		if host, ok := s.hosts[key]; ok {
+			return s.subnetForIP(net.ParseIP(host.IPv4))
 		}
 	}
-	return resp, nil
+	for _, sn := range s.subnets {
+		if sn.matchesCircuitID(info.CircuitID) {
+			return sn
+		}
+	}
+	for _, sn := range s.subnets {
+		if sn.matchesRemoteID(info.RemoteID) {
+			return sn
+		}
+	}
+	return nil
+}
+
+func (s *Server) subnetForIP(ip net.IP) *Subnet {
+	for _, sn := range s.subnets {
+		if sn.Contains(ip) {
+			return sn
+		}
+	}
+	return nil
 }
 
+// HandleListen starts a listener, replacing the running one for the same subnet.
 func (s *Server) HandleListen(listen *Listen) error {
-	listener, err := NewListener(listen, s.getLease, s.dhcpServerFactory, s.responderFactory)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findListener(listen.Subnet) != nil {
+		s.stopListen(listen.Subnet)
+	}
+	listener, err := NewListener(listen, s.getLease, s.handleNotification, s.dhcpServerFactory, s.responderFactory)
 	if err != nil {
 		return err
 	}
 	s.listeners = append(s.listeners, listener)
 	log.Printf("starting server %v", listener)
 	go func() {
-		err = listener.Serve()
-		log.Printf("exited server %v: %s", s, err)
-		//TODO: panic if exited unexpectedly
+		err := listener.Serve(func() {
+			s.mu.Lock()
+			listener.serving = true
+			s.mu.Unlock()
+		})
+		s.listenerExited(listener, err)
 	}()
 	return nil
 }
 
+// listenerExited records the exit of listener, which is unexpected unless
+// the listener was stopped. The error is kept until the listener of the
+// subnet is replaced or stopped.
+func (s *Server) listenerExited(listener *Listener, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	listener.serving = false
+	for _, l := range s.listeners {
+		if l == listener {
+			log.Printf("server %v exited unexpectedly: %v", listener, err)
+			listener.exitErr = fmt.Errorf("server %v exited unexpectedly: %v", listener, err)
+			return
+		}
+	}
+	log.Printf("exited server %v: %v", listener, err)
+}
+
+// Live returns an error while a listener which exited unexpectedly is not
+// replaced, so the process is restarted instead of leaving its clients
+// unanswered.
+func (s *Server) Live() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, l := range s.listeners {
+		if l.exitErr != nil {
+			return l.exitErr
+		}
+	}
+	return nil
+}
+
+// Ready returns an error unless all listeners are serving.
+func (s *Server) Ready() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, l := range s.listeners {
+		if l.exitErr != nil {
+			return l.exitErr
+		}
+		if !l.serving {
+			return fmt.Errorf("server %v is not serving", l)
+		}
+	}
+	return nil
+}
+
+// HandleSubnet starts serving subnet. If the subnet is already served, its
+// configuration is replaced and the leases are kept.
 func (s *Server) HandleSubnet(subnet *Subnet) error {
 	var err error
 	subnet, err = InitializeSubnet(subnet)
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.subnets {
+		if other.Subnet == subnet.Subnet {
+			continue
+		}
+		err = subnet.checkRelayRules(other)
+		if err != nil {
+			return err
+		}
+	}
+	if s.failover != nil {
+		subnet.attachPool(s.failover.pool(subnet.Subnet))
+	}
+	if old, ok := s.subnets[subnet.Subnet]; ok {
+		subnet.adoptLeases(old)
+	}
+	for _, host := range s.hosts {
+		if subnet.Contains(net.ParseIP(host.IPv4)) {
+			err = subnet.AddHost(host)
+			if err != nil {
+				log.Printf("failed to add host %s: %s", host.Key(), err)
+			}
+		}
+	}
+	if subnet.pool != nil {
+		subnet.applyPool()
+	}
 	s.subnets[subnet.Subnet] = subnet
 	log.Printf("Serving subnet %v", subnet)
-	return err
+	return nil
 }
 
-func (s *Server) HandleLease(lease *Lease) error {
+// HandleHost adds or replaces a static host reservation.
+func (s *Server) HandleHost(host *Host) error {
+	host, err := InitializeHost(host)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeHost(host.Key())
+	s.hosts[host.Key()] = host
+	subnet := s.subnetForIP(net.ParseIP(host.IPv4))
+	if subnet == nil {
+		log.Printf("subnet for host %s (%s) not found yet", host.Key(), host.IPv4)
+		return nil
+	}
+	return subnet.AddHost(host)
+}
+
+func (s *Server) RemoveHost(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeHost(key)
+}
+
+func (s *Server) removeHost(key string) {
+	host, ok := s.hosts[key]
+	if !ok {
+		return
+	}
+	delete(s.hosts, key)
 	for _, sn := range s.subnets {
-		if sn.ipNet.Contains(net.ParseIP(lease.IP)) {
-			sn.leaseCache[lease.MAC] = lease
-			return nil
+		sn.RemoveHost(host.Key())
+	}
+}
+
+// HandleLease restores a persisted lease into the subnet cache.
+func (s *Server) HandleLease(lease *Lease) error {
+	s.mu.RLock()
+	sn, ok := s.subnets[lease.Subnet]
+	if !ok {
+		sn = s.subnetForIP(net.ParseIP(lease.IP))
+	}
+	s.mu.RUnlock()
+	if sn == nil {
+		return fmt.Errorf("subnet for lease not found: %v", lease)
+	}
+	return sn.AddLease(lease)
+}
+
+// RemoveLease forgets the lease of ip removed from storage, e.g. released or
+// expired at another server.
+func (s *Server) RemoveLease(ip string) {
+	s.mu.RLock()
+	sn := s.subnetForIP(net.ParseIP(ip))
+	s.mu.RUnlock()
+	if sn != nil {
+		sn.removeLease(ip)
+	}
+}
+
+func (s *Server) RemoveSubnet(subnet string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subnets[subnet]; !ok {
+		log.Printf("Subnet %q not found", subnet)
+		return
+	}
+	delete(s.subnets, subnet)
+	log.Printf("Stopped serving subnet %q", subnet)
+}
+
+func (s *Server) findListener(subnet string) *Listener {
+	for _, l := range s.listeners {
+		if l.listen.Subnet == subnet {
+			return l
 		}
 	}
-	return fmt.Errorf("subnet for lease not found: %v", lease)
+	return nil
 }
 
 func (s *Server) StopListen(subnet string) {
-	for _, l := range s.listeners {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopListen(subnet)
+}
+
+func (s *Server) stopListen(subnet string) {
+	for i, l := range s.listeners {
 		if l.listen.Subnet == subnet {
 			err := l.server.Close()
 			if err != nil {
 				log.Printf("Failed to stop server: %s", err)
 			}
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
 			return
 		}
 	}
 	log.Printf("Listener for subnet %q not found", subnet)
 }
 
+// Close stops all listeners. They are removed before they exit, so the
+// shutdown is not taken for a failure.
 func (s *Server) Close() {
-	for _, l := range s.listeners {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.listeners = nil
+	s.mu.Unlock()
+	for _, l := range listeners {
 		err := l.server.Close()
 		if err != nil {
 			log.Printf("failed to close listener: %s %s", l, err)
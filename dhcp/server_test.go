@@ -2,17 +2,23 @@ package dhcp
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
 	"github.com/insomniacslk/dhcp/iana"
 	"log"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
 
 type FakeDHCPServer struct {
 	handler server4.Handler
+	// exit makes Serve return the error sent to it, if set
+	exit chan error
 }
 type FakeDHCPServerFactory struct {
 	fakeDHCPServer *FakeDHCPServer
@@ -32,18 +38,23 @@ type ResponderSendUnicastCall struct {
 }
 
 type FakeResponder struct {
-	callsUnicast   []ResponderSendUnicastCall
-	callsBroadcast []dhcpv4.DHCPv4
+	mu                   sync.Mutex
+	callsUnicast         []ResponderSendUnicastCall
+	callsBroadcast       []dhcpv4.DHCPv4
+	callsHardwareUnicast []dhcpv4.DHCPv4
 }
 
 func NewFakeResponder() *FakeResponder {
 	return &FakeResponder{
-		callsUnicast:   make([]ResponderSendUnicastCall, 0),
-		callsBroadcast: make([]dhcpv4.DHCPv4, 0),
+		callsUnicast:         make([]ResponderSendUnicastCall, 0),
+		callsBroadcast:       make([]dhcpv4.DHCPv4, 0),
+		callsHardwareUnicast: make([]dhcpv4.DHCPv4, 0),
 	}
 }
 
 func (f *FakeResponder) SendUnicast(resp *dhcpv4.DHCPv4, peer net.Addr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.callsUnicast = append(f.callsUnicast, ResponderSendUnicastCall{
 		resp: resp,
 		peer: peer,
@@ -52,22 +63,53 @@ func (f *FakeResponder) SendUnicast(resp *dhcpv4.DHCPv4, peer net.Addr) error {
 }
 
 func (f *FakeResponder) SendBroadcast(resp *dhcpv4.DHCPv4) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.callsBroadcast = append(f.callsBroadcast, *resp)
 	return nil
 }
 
+func (f *FakeResponder) SendHardwareUnicast(resp *dhcpv4.DHCPv4) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.callsHardwareUnicast = append(f.callsHardwareUnicast, *resp)
+	return nil
+}
+
 func (f *FakeResponder) Close() {}
 
+// findBroadcast returns the broadcast reply of msgType to transaction xid.
+func (f *FakeResponder) findBroadcast(xid dhcpv4.TransactionID, msgType dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.callsBroadcast {
+		if f.callsBroadcast[i].TransactionID == xid && f.callsBroadcast[i].MessageType() == msgType {
+			resp := f.callsBroadcast[i]
+			return &resp
+		}
+	}
+	return nil
+}
+
 func (f *FakeResponderFactory) NewResponder(listen *Listen) (Responder, error) {
 	return f.responder, nil
 }
 
 func (f *FakeDHCPServer) Serve() error {
+	if f.exit != nil {
+		return <-f.exit
+	}
 	time.Sleep(time.Hour)
 	return nil
 }
 
 func (f *FakeDHCPServer) Close() error {
+	if f.exit != nil {
+		select {
+		case f.exit <- nil:
+		default:
+		}
+	}
 	return nil
 }
 
@@ -154,5 +196,930 @@ func TestNewServer(t *testing.T) {
 	assertEqual(t, "10.1.1.1", resp.ServerIPAddr.String())
 	assertTrue(t, 0 == bytes.Compare([]byte{0, 0, 14, 16}, resp.Options.Get(dhcpv4.OptionIPAddressLeaseTime)))
 	assertEqual(t, "192.168.10.100", resp.YourIPAddr.String())
+	assertEqual(t, "192.168.10.1", resp.GatewayIPAddr.String())
+	assertEqual(t, "192.168.10.1:67", responder.callsUnicast[0].peer.String())
 	log.Println(resp)
 }
+
+func TestUpdateOptions(t *testing.T) {
+	routers := func(resp *dhcpv4.DHCPv4) string { return fmt.Sprint(resp.Router()) }
+	dns := func(resp *dhcpv4.DHCPv4) string { return fmt.Sprint(resp.DNS()) }
+
+	resp := &dhcpv4.DHCPv4{}
+	updateOptions(resp, "10.1.1.1", []string{"10.1.1.2", "10.1.1.3"}, nil)
+	assertEqual(t, "[10.1.1.1]", routers(resp))
+	assertEqual(t, "[10.1.1.2 10.1.1.3]", dns(resp))
+
+	// no dns servers configured
+	resp = &dhcpv4.DHCPv4{}
+	updateOptions(resp, "", nil, nil)
+	assertTrue(t, !resp.Options.Has(dhcpv4.OptionRouter))
+	assertTrue(t, !resp.Options.Has(dhcpv4.OptionDomainNameServer))
+
+	// options configured by name are not overwritten
+	resp = &dhcpv4.DHCPv4{}
+	updateOptions(resp, "10.1.1.1", []string{"10.1.1.2"}, []Option{
+		{ID: 3, Type: "ip-list", Value: "10.1.1.254"},
+		{ID: 6, Type: "ip-list", Value: "10.9.9.9,10.9.9.8"},
+	})
+	assertEqual(t, "[10.1.1.254]", routers(resp))
+	assertEqual(t, "[10.9.9.9 10.9.9.8]", dns(resp))
+}
+
+func TestServer_Release(t *testing.T) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	var persisted []Lease
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+		HandleLease: func(lease *Lease) error {
+			persisted = append(persisted, *lease)
+			return nil
+		},
+	})
+	err := s.HandleListen(&Listen{
+		Interface: "eth0",
+		Subnet:    "10.1.1.0/24",
+		Laddr:     "10.1.1.1",
+	})
+	assertNoError(t, err)
+	err = s.HandleSubnet(&Subnet{
+		Subnet:    "10.1.1.0/24",
+		RangeFrom: "10.1.1.100",
+		RangeTo:   "10.1.1.100",
+		Gateway:   "10.1.1.1",
+	})
+	assertNoError(t, err)
+
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	req, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true))
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, req)
+	assertEqual(t, 1, len(responder.callsBroadcast))
+	assertEqual(t, "10.1.1.100", responder.callsBroadcast[0].YourIPAddr.String())
+
+	release, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithClientIP(net.ParseIP("10.1.1.100")),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.ParseIP("10.1.1.2"))),
+	)
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, release)
+	assertEqual(t, 0, len(persisted))
+
+	release.UpdateOption(dhcpv4.OptServerIdentifier(net.ParseIP("10.1.1.1")))
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, release)
+	assertEqual(t, 1, len(persisted))
+	assertEqual(t, LeaseStateReleased, persisted[0].State)
+	assertEqual(t, "10.1.1.100", persisted[0].IP)
+
+	req, err = dhcpv4.NewDiscovery(net.HardwareAddr{1, 2, 3, 4, 5, 7}, dhcpv4.WithBroadcast(true))
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, req)
+	assertEqual(t, 2, len(responder.callsBroadcast))
+	assertEqual(t, "10.1.1.100", responder.callsBroadcast[1].YourIPAddr.String())
+}
+
+func TestServer_Nak(t *testing.T) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+	})
+	err := s.HandleListen(&Listen{
+		Interface: "eth0",
+		Subnet:    "10.1.1.0/24",
+		Laddr:     "10.1.1.1",
+	})
+	assertNoError(t, err)
+	err = s.HandleSubnet(&Subnet{
+		Subnet:    "10.1.1.0/24",
+		RangeFrom: "10.1.1.100",
+		RangeTo:   "10.1.1.110",
+		Gateway:   "10.1.1.1",
+	})
+	assertNoError(t, err)
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	newRequest := func(ip string, serverID string) *dhcpv4.DHCPv4 {
+		req, err := dhcpv4.New(
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+			dhcpv4.WithHwAddr(mac),
+			dhcpv4.WithBroadcast(true),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP(ip))),
+		)
+		assertNoError(t, err)
+		if serverID != "" {
+			req.UpdateOption(dhcpv4.OptServerIdentifier(net.ParseIP(serverID)))
+		}
+		return req
+	}
+
+	// INIT-REBOOT from unknown client is ignored
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newRequest("10.1.1.100", ""))
+	assertEqual(t, 0, len(responder.callsBroadcast))
+
+	// INIT-REBOOT on the wrong network
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newRequest("10.2.2.100", ""))
+	assertEqual(t, 1, len(responder.callsBroadcast))
+	nak := responder.callsBroadcast[0]
+	assertEqual(t, dhcpv4.MessageTypeNak, nak.MessageType())
+	assertTrue(t, nak.YourIPAddr.IsUnspecified())
+	assertEqual(t, "10.1.1.1", nak.ServerIdentifier().String())
+
+	discover, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true))
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, discover)
+	assertEqual(t, 2, len(responder.callsBroadcast))
+	assertEqual(t, "10.1.1.100", responder.callsBroadcast[1].YourIPAddr.String())
+
+	// SELECTING with address other than offered
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newRequest("10.1.1.105", "10.1.1.1"))
+	assertEqual(t, 3, len(responder.callsBroadcast))
+	assertEqual(t, dhcpv4.MessageTypeNak, responder.callsBroadcast[2].MessageType())
+
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newRequest("10.1.1.100", "10.1.1.1"))
+	assertEqual(t, 4, len(responder.callsBroadcast))
+	assertEqual(t, dhcpv4.MessageTypeAck, responder.callsBroadcast[3].MessageType())
+}
+
+func TestServer_Inform(t *testing.T) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+	})
+	err := s.HandleListen(&Listen{
+		Interface: "eth0",
+		Subnet:    "10.1.1.0/24",
+		Laddr:     "10.1.1.1",
+	})
+	assertNoError(t, err)
+	err = s.HandleSubnet(&Subnet{
+		Subnet:    "10.1.1.0/24",
+		RangeFrom: "10.1.1.100",
+		RangeTo:   "10.1.1.110",
+		Gateway:   "10.1.1.1",
+		DNS:       []string{"1.1.1.1"},
+		Options:   []Option{{ID: 67, Type: "string", Value: "boot.pxe"}},
+	})
+	assertNoError(t, err)
+
+	req, err := dhcpv4.NewInform(net.HardwareAddr{1, 2, 3, 4, 5, 6}, net.ParseIP("10.1.1.20"))
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, req)
+	assertEqual(t, 0, len(responder.callsBroadcast))
+	assertEqual(t, 1, len(responder.callsUnicast))
+	call := responder.callsUnicast[0]
+	assertEqual(t, "10.1.1.20:68", call.peer.String())
+	assertEqual(t, dhcpv4.MessageTypeAck, call.resp.MessageType())
+	assertTrue(t, call.resp.YourIPAddr.IsUnspecified())
+	assertTrue(t, call.resp.Options.Get(dhcpv4.OptionIPAddressLeaseTime) == nil)
+	assertEqual(t, "boot.pxe", call.resp.BootFileNameOption())
+	assertEqual(t, "1.1.1.1", call.resp.DNS()[0].String())
+	assertEqual(t, 0, s.subnets["10.1.1.0/24"].leases.Len())
+}
+
+func TestServer_ServerID(t *testing.T) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	var persisted []Lease
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+		HandleLease: func(lease *Lease) error {
+			persisted = append(persisted, *lease)
+			return nil
+		},
+	})
+	err := s.HandleListen(&Listen{
+		Interface: "eth0",
+		Subnet:    "10.1.1.0/24",
+		Laddr:     "10.1.1.2",
+	})
+	assertNoError(t, err)
+	err = s.HandleSubnet(&Subnet{
+		Subnet:    "10.1.1.0/24",
+		RangeFrom: "10.1.1.100",
+		RangeTo:   "10.1.1.110",
+		Gateway:   "10.1.1.1",
+	})
+	assertNoError(t, err)
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	discover, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true))
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, discover)
+	assertEqual(t, 1, len(responder.callsBroadcast))
+	offer := responder.callsBroadcast[0]
+	assertEqual(t, "10.1.1.2", offer.ServerIdentifier().String())
+	assertEqual(t, 0, len(persisted))
+
+	req, err := dhcpv4.NewRequestFromOffer(&offer)
+	assertNoError(t, err)
+	req.UpdateOption(dhcpv4.OptServerIdentifier(net.ParseIP("10.1.1.3")))
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, req)
+	assertEqual(t, 1, len(responder.callsBroadcast))
+
+	req.UpdateOption(dhcpv4.OptServerIdentifier(net.ParseIP("10.1.1.2")))
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, req)
+	assertEqual(t, 2, len(responder.callsBroadcast))
+	assertEqual(t, dhcpv4.MessageTypeAck, responder.callsBroadcast[1].MessageType())
+	assertEqual(t, 1, len(persisted))
+	assertEqual(t, LeaseStateBound, persisted[0].State)
+
+	s.subnets["10.1.1.0/24"].ServerID = "10.1.1.3"
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, discover)
+	assertEqual(t, 3, len(responder.callsBroadcast))
+	assertEqual(t, "10.1.1.3", responder.callsBroadcast[2].ServerIdentifier().String())
+}
+
+func TestServer_HandleLease(t *testing.T) {
+	s := NewServer(ServerConfig{})
+	err := s.HandleSubnet(&Subnet{
+		Subnet:    "10.1.1.0/24",
+		RangeFrom: "10.1.1.100",
+		RangeTo:   "10.1.1.101",
+	})
+	assertNoError(t, err)
+	err = s.HandleLease(&Lease{Subnet: "10.1.1.0/24", MAC: "01:02:03:04:05:06", IP: "10.1.1.100", LastUpdate: time.Now()})
+	assertNoError(t, err)
+	err = s.HandleLease(&Lease{MAC: "01:02:03:04:05:07", IP: "10.2.1.100", LastUpdate: time.Now()})
+	assertTrue(t, err != nil)
+
+	sn := s.subnets["10.1.1.0/24"]
+	lease := sn.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{1, 2, 3, 4, 5, 6}})
+	assertEqual(t, "10.1.1.100", lease.IP)
+	assertEqual(t, LeaseStateBound, lease.State)
+	lease = sn.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: net.HardwareAddr{1, 2, 3, 4, 5, 8}})
+	assertEqual(t, "10.1.1.101", lease.IP)
+}
+
+func TestServer_Reconfigure(t *testing.T) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+	})
+	listen := &Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}
+	assertNoError(t, s.HandleListen(listen))
+	assertNoError(t, s.HandleListen(listen))
+	assertEqual(t, 1, len(s.listeners))
+	assertNoError(t, s.HandleSubnet(&Subnet{
+		Subnet:    "10.1.1.0/24",
+		RangeFrom: "10.1.1.100",
+		RangeTo:   "10.1.1.110",
+		Gateway:   "10.1.1.1",
+	}))
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	lease := s.subnets["10.1.1.0/24"].GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: mac})
+	assertEqual(t, "10.1.1.100", lease.IP)
+
+	assertNoError(t, s.HandleSubnet(&Subnet{
+		Subnet:    "10.1.1.0/24",
+		RangeFrom: "10.1.1.50",
+		RangeTo:   "10.1.1.150",
+		Gateway:   "10.1.1.1",
+		DNS:       []string{"1.1.1.1"},
+	}))
+	lease = s.subnets["10.1.1.0/24"].GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: mac})
+	assertEqual(t, "10.1.1.100", lease.IP)
+	assertEqual(t, "1.1.1.1", lease.DNS[0])
+
+	s.RemoveSubnet("10.1.1.0/24")
+	assertEqual(t, 0, len(s.subnets))
+	s.StopListen("10.1.1.0/24")
+	assertEqual(t, 0, len(s.listeners))
+}
+
+func TestServer_RelaySubnetSelection(t *testing.T) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+	})
+	assertNoError(t, s.HandleListen(&Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}))
+	for _, sn := range []string{"10.1.1", "10.2.1", "10.3.1", "10.4.1"} {
+		assertNoError(t, s.HandleSubnet(&Subnet{
+			Subnet:    sn + ".0/24",
+			RangeFrom: sn + ".100",
+			RangeTo:   sn + ".110",
+			Gateway:   sn + ".1",
+		}))
+	}
+	newDiscover := func(mac byte) *dhcpv4.DHCPv4 {
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{1, 2, 3, 4, 5, mac}, dhcpv4.WithRelay(net.ParseIP("10.2.1.1")))
+		assertNoError(t, err)
+		return req
+	}
+
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newDiscover(1))
+	assertEqual(t, "10.2.1.100", responder.callsUnicast[0].resp.YourIPAddr.String())
+
+	req := newDiscover(2)
+	req.UpdateOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.LinkSelectionSubOption, []byte{10, 3, 1, 0})))
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, req)
+	resp := responder.callsUnicast[1].resp
+	assertEqual(t, "10.3.1.100", resp.YourIPAddr.String())
+	assertEqual(t, "10.2.1.1", resp.GatewayIPAddr.String())
+	assertTrue(t, resp.RelayAgentInfo() != nil)
+
+	req = newDiscover(3)
+	req.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionSubnetSelection, []byte{10, 4, 1, 0}))
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, req)
+	assertEqual(t, "10.4.1.100", responder.callsUnicast[2].resp.YourIPAddr.String())
+	assertEqual(t, "10.2.1.1:67", responder.callsUnicast[2].peer.String())
+}
+
+func TestServer_RelayAgentInfo(t *testing.T) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+	})
+	assertNoError(t, s.HandleListen(&Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}))
+	assertNoError(t, s.HandleSubnet(&Subnet{Subnet: "10.2.1.0/24", RangeFrom: "10.2.1.100", RangeTo: "10.2.1.110", Gateway: "10.2.1.1"}))
+	assertNoError(t, s.HandleSubnet(&Subnet{Subnet: "10.3.1.0/24", RangeFrom: "10.3.1.100", RangeTo: "10.3.1.110", Gateway: "10.3.1.1",
+		RemoteIDs: []string{"rack-3"}}))
+	assertNoError(t, s.HandleHost(&Host{CircuitID: "eth1/0/12", Relay: "10.2.1.1", IPv4: "10.2.1.12",
+		Options: []Option{{ID: 67, Type: "string", Value: "port-12.pxe"}}}))
+	relayInfo := func(circuitID string, remoteID string) dhcpv4.Modifier {
+		return dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(
+			dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte(circuitID)),
+			dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, []byte(remoteID)),
+		))
+	}
+	newDiscover := func(mac byte, circuitID string, remoteID string) *dhcpv4.DHCPv4 {
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{1, 2, 3, 4, 5, mac}, dhcpv4.WithRelay(net.ParseIP("10.2.1.1")), relayInfo(circuitID, remoteID))
+		assertNoError(t, err)
+		return req
+	}
+
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newDiscover(1, "eth1/0/12", "rack-2"))
+	resp := responder.callsUnicast[0].resp
+	assertEqual(t, "10.2.1.12", resp.YourIPAddr.String())
+	assertEqual(t, "port-12.pxe", resp.BootFileNameOption())
+	assertEqual(t, RelayInfo{CircuitID: "eth1/0/12", RemoteID: "rack-2"}, GetRelayInfo(resp))
+
+	// device on the port is replaced before it was acknowledged
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newDiscover(2, "eth1/0/12", "rack-2"))
+	offer := responder.callsUnicast[1].resp
+	assertEqual(t, "10.2.1.12", offer.YourIPAddr.String())
+	request, err := dhcpv4.NewRequestFromOffer(offer, dhcpv4.WithRelay(net.ParseIP("10.2.1.1")), relayInfo("eth1/0/12", "rack-2"))
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, request)
+	assertEqual(t, dhcpv4.MessageTypeAck, responder.callsUnicast[2].resp.MessageType())
+
+	// acknowledged device keeps the address until it is released
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newDiscover(3, "eth1/0/12", "rack-2"))
+	assertEqual(t, 3, len(responder.callsUnicast))
+	release, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithHwAddr(net.HardwareAddr{1, 2, 3, 4, 5, 2}),
+		dhcpv4.WithClientIP(offer.YourIPAddr),
+		dhcpv4.WithOptionCopied(offer, dhcpv4.OptionServerIdentifier),
+	)
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, release)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newDiscover(3, "eth1/0/12", "rack-2"))
+	assertEqual(t, "10.2.1.12", responder.callsUnicast[3].resp.YourIPAddr.String())
+
+	// the same circuit-id behind another relay agent is another port
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{1, 2, 3, 4, 5, 4}, dhcpv4.WithRelay(net.ParseIP("10.2.1.2")), relayInfo("eth1/0/12", ""))
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, req)
+	assertEqual(t, "10.2.1.100", responder.callsUnicast[4].resp.YourIPAddr.String())
+
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newDiscover(5, "eth1/0/1", "rack-3"))
+	assertEqual(t, "10.3.1.100", responder.callsUnicast[5].resp.YourIPAddr.String())
+
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, newDiscover(6, "eth1/0/1", "rack-2"))
+	assertEqual(t, "10.2.1.101", responder.callsUnicast[6].resp.YourIPAddr.String())
+
+	// relay rules of subnets must not overlap
+	err = s.HandleSubnet(&Subnet{Subnet: "10.4.1.0/24", RangeFrom: "10.4.1.100", RangeTo: "10.4.1.110", RemoteIDs: []string{"rack-3"}})
+	assertTrue(t, err != nil)
+	_, err = InitializeHost(&Host{CircuitID: "eth1/0/12", IPv4: "10.2.1.12"})
+	assertTrue(t, err != nil)
+}
+
+func TestServer_ReplyTransport(t *testing.T) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+	})
+	assertNoError(t, s.HandleListen(&Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}))
+	assertNoError(t, s.HandleSubnet(&Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.100", RangeTo: "10.1.1.110", Gateway: "10.1.1.1"}))
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+
+	// broadcast flag is clear
+	discover, err := dhcpv4.NewDiscovery(mac)
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, discover)
+	assertEqual(t, 1, len(responder.callsHardwareUnicast))
+	offer := responder.callsHardwareUnicast[0]
+	assertEqual(t, "10.1.1.100", offer.YourIPAddr.String())
+
+	// broadcast flag is set
+	discover.SetBroadcast()
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, discover)
+	assertEqual(t, 1, len(responder.callsBroadcast))
+
+	// RENEWING client
+	renew, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithClientIP(net.ParseIP("10.1.1.100")),
+	)
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, renew)
+	assertEqual(t, 1, len(responder.callsUnicast))
+	assertEqual(t, "10.1.1.100:68", responder.callsUnicast[0].peer.String())
+	assertEqual(t, dhcpv4.MessageTypeAck, responder.callsUnicast[0].resp.MessageType())
+
+	// NAK is broadcast even to the client with address
+	renew.ClientIPAddr = net.ParseIP("10.2.1.100")
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, renew)
+	assertEqual(t, 2, len(responder.callsBroadcast))
+	assertEqual(t, dhcpv4.MessageTypeNak, responder.callsBroadcast[1].MessageType())
+}
+
+// runClient gets the address for mac by DISCOVER and REQUEST through handler.
+// It returns the acknowledged address or nil.
+func runClient(handler func(net.PacketConn, net.Addr, *dhcpv4.DHCPv4), responder *FakeResponder, mac net.HardwareAddr, modifiers ...dhcpv4.Modifier) net.IP {
+	discover, err := dhcpv4.NewDiscovery(mac, append(modifiers, dhcpv4.WithBroadcast(true))...)
+	if err != nil {
+		return nil
+	}
+	handler(&FakePacketConn{}, &FakeNetAddr{}, discover)
+	offer := responder.findBroadcast(discover.TransactionID, dhcpv4.MessageTypeOffer)
+	if offer == nil {
+		return nil
+	}
+	request, err := dhcpv4.NewRequestFromOffer(offer, append(modifiers, dhcpv4.WithBroadcast(true))...)
+	if err != nil {
+		return nil
+	}
+	handler(&FakePacketConn{}, &FakeNetAddr{}, request)
+	ack := responder.findBroadcast(request.TransactionID, dhcpv4.MessageTypeAck)
+	if ack == nil {
+		return nil
+	}
+	return ack.YourIPAddr
+}
+
+func newStressServer(persisted *int64, mu *sync.Mutex) (*Server, *FakeDHCPServer, *FakeResponder) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+		HandleLease: func(lease *Lease) error {
+			mu.Lock()
+			defer mu.Unlock()
+			*persisted++
+			return nil
+		},
+	})
+	return s, fs, responder
+}
+
+func TestServer_ConcurrentClients(t *testing.T) {
+	var (
+		persisted int64
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+	)
+	s, fs, responder := newStressServer(&persisted, &mu)
+	assertNoError(t, s.HandleListen(&Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}))
+	assertNoError(t, s.HandleSubnet(&Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.10", RangeTo: "10.1.1.250", Gateway: "10.1.1.1"}))
+
+	const clients = 200
+	addrs := make([]net.IP, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addrs[i] = runClient(fs.handler, responder, net.HardwareAddr{2, 0, 0, 0, byte(i >> 8), byte(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i, ip := range addrs {
+		if ip == nil {
+			t.Fatalf("client %d got no address", i)
+		}
+		assertTrue(t, !seen[ip.String()])
+		seen[ip.String()] = true
+	}
+	assertEqual(t, int64(clients), persisted)
+}
+
+func TestServer_ConcurrentReconfigure(t *testing.T) {
+	var (
+		persisted int64
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+	)
+	s, fs, responder := newStressServer(&persisted, &mu)
+	listen := &Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}
+	assertNoError(t, s.HandleListen(listen))
+	newSubnet := func() *Subnet {
+		return &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.10", RangeTo: "10.1.1.250", Gateway: "10.1.1.1"}
+	}
+	assertNoError(t, s.HandleSubnet(newSubnet()))
+	handler := fs.handler
+
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assertNoError(t, s.HandleSubnet(newSubnet()))
+			assertNoError(t, s.HandleHost(&Host{MAC: "02:ff:00:00:00:01", IPv4: "10.1.1.5"}))
+			assertNoError(t, s.HandleLease(&Lease{Subnet: "10.1.1.0/24", MAC: fmt.Sprintf("02:fe:00:00:00:%02x", i%256), IP: "10.1.1.2", LastUpdate: time.Now()}))
+			s.RemoveHost("02:ff:00:00:00:01")
+			s.Close()
+		}
+	}()
+
+	const clients = 100
+	addrs := make([]net.IP, clients)
+	var clientsWg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		clientsWg.Add(1)
+		go func(i int) {
+			defer clientsWg.Done()
+			addrs[i] = runClient(handler, responder, net.HardwareAddr{2, 0, 0, 0, byte(i >> 8), byte(i)})
+		}(i)
+	}
+	clientsWg.Wait()
+	close(stop)
+	wg.Wait()
+
+	// requests in flight during reconfiguration may be refused, but an address
+	// is never acknowledged to two clients,
+	// and the acknowledged leases are kept by the latest subnet
+	subnet := s.subnetList()[0]
+	seen := make(map[string]bool)
+	for i, ip := range addrs {
+		if ip == nil {
+			continue
+		}
+		assertTrue(t, !seen[ip.String()])
+		seen[ip.String()] = true
+		lease := subnet.leases.ByIP(ip.String())
+		assertTrue(t, lease != nil)
+		if lease != nil {
+			assertEqual(t, net.HardwareAddr{2, 0, 0, 0, byte(i >> 8), byte(i)}.String(), lease.MAC)
+			assertEqual(t, LeaseStateBound, lease.State)
+		}
+	}
+	assertNoError(t, s.HandleListen(listen))
+	s.StopListen(listen.Subnet)
+	assertEqual(t, 0, len(s.listeners))
+}
+
+func TestServer_ReplacedSubnet(t *testing.T) {
+	s := NewServer(ServerConfig{})
+	newSubnet := func() *Subnet {
+		return &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.10", RangeTo: "10.1.1.20"}
+	}
+	assertNoError(t, s.HandleSubnet(newSubnet()))
+	old := s.subnetList()[0]
+	assertNoError(t, s.HandleSubnet(newSubnet()))
+	current := s.subnetList()[0]
+	assertTrue(t, old != current)
+
+	// request which found the subnet before it was replaced binds the lease
+	// in the current one
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 1})
+	assertNoError(t, err)
+	lease, _ := old.leaseFor(req, true)
+	assertTrue(t, lease != nil)
+	assertEqual(t, 0, old.leases.Len())
+	cached := current.leases.ByIP(lease.IP)
+	assertTrue(t, cached != nil)
+	assertEqual(t, LeaseStateBound, cached.State)
+
+	req, err = dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 2})
+	assertNoError(t, err)
+	other := current.GetLeaseForMAC(req)
+	assertTrue(t, other != nil)
+	assertTrue(t, other.IP != lease.IP)
+}
+
+func TestServer_ClientID(t *testing.T) {
+	var persisted []Lease
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+		HandleLease: func(lease *Lease) error {
+			persisted = append(persisted, *lease)
+			return nil
+		},
+	})
+	assertNoError(t, s.HandleListen(&Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}))
+	assertNoError(t, s.HandleSubnet(&Subnet{
+		Subnet:    "10.1.1.0/24",
+		RangeFrom: "10.1.1.100",
+		RangeTo:   "10.1.1.110",
+		LeaseKey:  LeaseKeyClientID,
+		Options:   []Option{{ID: 61, Type: OptionTypeString, Value: "server"}},
+	}))
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	for i, id := range []string{"vm1", "vm2"} {
+		addr := runClient(fs.handler, responder, mac, dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte(id))))
+		assertEqual(t, fmt.Sprintf("10.1.1.%d", 100+i), addr.String())
+		assertEqual(t, hex.EncodeToString([]byte(id)), persisted[i].ClientID)
+	}
+	// client identifier is echoed in replies (RFC 6842)
+	for _, resp := range responder.callsBroadcast {
+		assertTrue(t, bytes.HasPrefix(resp.Options.Get(dhcpv4.OptionClientIdentifier), []byte("vm")))
+	}
+}
+
+// fakeLeaseStorage is shared by servers like the etcd lease prefix: an address
+// is held by one client until the expiry.
+type fakeLeaseStorage struct {
+	mu      sync.Mutex
+	leases  map[string]Lease
+	servers []*Server
+}
+
+func (f *fakeLeaseStorage) claim(lease *Lease, expiry time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	holder, ok := f.leases[lease.IP]
+	if ok && (holder.MAC != lease.MAC || holder.ClientID != lease.ClientID) {
+		return fmt.Errorf("%w: %s", ErrLeaseTaken, lease.IP)
+	}
+	f.leases[lease.IP] = *lease
+	return nil
+}
+
+func (f *fakeLeaseStorage) handle(lease *Lease) error {
+	switch lease.State {
+	case LeaseStateOffered:
+		return nil
+	case LeaseStateReleased, LeaseStateExpired:
+		f.mu.Lock()
+		delete(f.leases, lease.IP)
+		f.mu.Unlock()
+		return nil
+	}
+	return f.claim(lease, time.Time{})
+}
+
+// sync delivers the stored leases to the servers like the lease prefix watch.
+func (f *fakeLeaseStorage) sync() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.servers {
+		for _, lease := range f.leases {
+			l := lease
+			_ = s.HandleLease(&l)
+		}
+	}
+}
+
+func newHAServer(t *testing.T, storage *fakeLeaseStorage, laddr string) (*Server, *FakeDHCPServer, *FakeResponder) {
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+		HandleLease:         storage.handle,
+		ClaimLease:          storage.claim,
+	})
+	assertNoError(t, s.HandleListen(&Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: laddr}))
+	assertNoError(t, s.HandleSubnet(&Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.100", RangeTo: "10.1.1.103", ServerID: "10.1.1.1"}))
+	storage.servers = append(storage.servers, s)
+	return s, fs, responder
+}
+
+func TestServer_StoreError(t *testing.T) {
+	storage := &fakeLeaseStorage{leases: make(map[string]Lease)}
+	var storeErr error
+	fs := &FakeDHCPServer{}
+	responder := NewFakeResponder()
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+		ResponderFactory:    &FakeResponderFactory{responder: responder},
+		HandleLease: func(lease *Lease) error {
+			if storeErr != nil {
+				return storeErr
+			}
+			return storage.handle(lease)
+		},
+		ClaimLease: func(lease *Lease, expiry time.Time) error {
+			if storeErr != nil {
+				return storeErr
+			}
+			return storage.claim(lease, expiry)
+		},
+	})
+	assertNoError(t, s.HandleListen(&Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}))
+	assertNoError(t, s.HandleSubnet(&Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.100", RangeTo: "10.1.1.103"}))
+	subnet := s.subnetList()[0]
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 1}
+	ip := runClient(fs.handler, responder, mac)
+	assertEqual(t, "10.1.1.100", ip.String())
+
+	// renewal which is not stored is not acknowledged and keeps the lease as it was
+	lease := subnet.leases.ByIP(ip.String())
+	lastUpdate := lease.LastUpdate
+	storeErr = errors.New("etcd timeout")
+	request, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithBroadcast(true),
+		dhcpv4.WithClientIP(ip),
+	)
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, request)
+	assertTrue(t, responder.findBroadcast(request.TransactionID, dhcpv4.MessageTypeAck) == nil)
+	assertEqual(t, LeaseStateBound, lease.State)
+	assertEqual(t, lastUpdate, lease.LastUpdate)
+
+	// offered address which is neither claimed nor bound is not kept
+	mac2 := net.HardwareAddr{1, 2, 3, 4, 5, 2}
+	assertTrue(t, runClient(fs.handler, responder, mac2) == nil)
+	assertTrue(t, subnet.leases.ByMAC(mac2.String()) == nil)
+	storeErr = nil
+	ip2 := runClient(fs.handler, responder, mac2)
+	assertTrue(t, ip2 != nil)
+
+	// bound address which is not stored goes back to the offer
+	mac3 := net.HardwareAddr{1, 2, 3, 4, 5, 3}
+	discover, err := dhcpv4.NewDiscovery(mac3, dhcpv4.WithBroadcast(true))
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, discover)
+	offer := responder.findBroadcast(discover.TransactionID, dhcpv4.MessageTypeOffer)
+	assertTrue(t, offer != nil)
+	storeErr = errors.New("etcd timeout")
+	request, err = dhcpv4.NewRequestFromOffer(offer, dhcpv4.WithBroadcast(true))
+	assertNoError(t, err)
+	fs.handler(&FakePacketConn{}, &FakeNetAddr{}, request)
+	assertTrue(t, responder.findBroadcast(request.TransactionID, dhcpv4.MessageTypeAck) == nil)
+	assertEqual(t, LeaseStateOffered, subnet.leases.ByIP(offer.YourIPAddr.String()).State)
+}
+
+func TestServer_ActiveActive(t *testing.T) {
+	storage := &fakeLeaseStorage{leases: make(map[string]Lease)}
+	_, fs1, responder1 := newHAServer(t, storage, "10.1.1.2")
+	s2, fs2, responder2 := newHAServer(t, storage, "10.1.1.3")
+
+	// both servers would allocate the first address
+	ip1 := runClient(fs1.handler, responder1, net.HardwareAddr{1, 2, 3, 4, 5, 1})
+	ip2 := runClient(fs2.handler, responder2, net.HardwareAddr{1, 2, 3, 4, 5, 2})
+	assertEqual(t, "10.1.1.100", ip1.String())
+	assertEqual(t, "10.1.1.101", ip2.String())
+
+	// REQUEST for an address taken at the other server is refused
+	request, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithHwAddr(net.HardwareAddr{1, 2, 3, 4, 5, 3}),
+		dhcpv4.WithBroadcast(true),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP("10.1.1.100"))),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.ParseIP("10.1.1.1"))),
+	)
+	assertNoError(t, err)
+	fs2.handler(&FakePacketConn{}, &FakeNetAddr{}, request)
+	assertTrue(t, responder2.findBroadcast(request.TransactionID, dhcpv4.MessageTypeNak) != nil)
+
+	// after the watch delivers leases of the other server, the cache is up to date
+	storage.sync()
+	sn := s2.subnets["10.1.1.0/24"]
+	assertEqual(t, "01:02:03:04:05:01", sn.leases.ByIP("10.1.1.100").MAC)
+	ip3 := runClient(fs2.handler, responder2, net.HardwareAddr{1, 2, 3, 4, 5, 3})
+	assertEqual(t, "10.1.1.102", ip3.String())
+
+	// binding fails if another server took the address meanwhile
+	storage.mu.Lock()
+	storage.leases["10.1.1.102"] = Lease{IP: "10.1.1.102", MAC: "01:02:03:04:05:09"}
+	storage.mu.Unlock()
+	request.ClientHWAddr = net.HardwareAddr{1, 2, 3, 4, 5, 3}
+	request.TransactionID = dhcpv4.TransactionID{9, 9, 9, 9}
+	request.UpdateOption(dhcpv4.OptRequestedIPAddress(net.ParseIP("10.1.1.102")))
+	fs2.handler(&FakePacketConn{}, &FakeNetAddr{}, request)
+	assertTrue(t, responder2.findBroadcast(request.TransactionID, dhcpv4.MessageTypeNak) != nil)
+	assertTrue(t, sn.leases.ByIP("10.1.1.102") == nil)
+
+	// removed at the other server
+	s2.RemoveLease("10.1.1.100")
+	assertTrue(t, sn.leases.ByIP("10.1.1.100") == nil)
+	storage.mu.Lock()
+	assertEqual(t, 3, len(storage.leases))
+	storage.mu.Unlock()
+}
+
+func TestServer_LoadBalance(t *testing.T) {
+	newServer := func(role string) (*Server, *FakeDHCPServer, *FakeResponder) {
+		fs := &FakeDHCPServer{}
+		responder := NewFakeResponder()
+		s := NewServer(ServerConfig{
+			DHCPv4ServerFactory: &FakeDHCPServerFactory{fakeDHCPServer: fs},
+			ResponderFactory:    &FakeResponderFactory{responder: responder},
+			HandleLease:         func(lease *Lease) error { return nil },
+		})
+		assertNoError(t, s.HandleListen(&Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}))
+		assertNoError(t, s.HandleSubnet(&Subnet{
+			Subnet:      "10.1.1.0/24",
+			RangeFrom:   "10.1.1.100",
+			RangeTo:     "10.1.1.110",
+			LoadBalance: &LoadBalance{Role: role, Split: 128},
+		}))
+		return s, fs, responder
+	}
+	s1, fs1, responder1 := newServer(LoadBalancePrimary)
+	_, fs2, responder2 := newServer(LoadBalanceSecondary)
+
+	// hashed to bucket 102 of the primary and 153 of the secondary server
+	mac1 := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	mac2 := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	assertEqual(t, "10.1.1.100", runClient(fs1.handler, responder1, mac1).String())
+	assertTrue(t, runClient(fs2.handler, responder2, mac1) == nil)
+	assertEqual(t, "10.1.1.100", runClient(fs2.handler, responder2, mac2).String())
+	assertTrue(t, runClient(fs1.handler, responder1, mac2) == nil)
+
+	// renewing client is answered by the server which knows it
+	request, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithHwAddr(mac1),
+		dhcpv4.WithBroadcast(true),
+		dhcpv4.WithClientIP(net.ParseIP("10.1.1.100")),
+	)
+	assertNoError(t, err)
+	assertNoError(t, s1.HandleSubnet(&Subnet{
+		Subnet:      "10.1.1.0/24",
+		RangeFrom:   "10.1.1.100",
+		RangeTo:     "10.1.1.110",
+		LoadBalance: &LoadBalance{Role: LoadBalancePrimary, Split: 0},
+	}))
+	fs1.handler(&FakePacketConn{}, &FakeNetAddr{}, request)
+	assertEqual(t, 1, len(responder1.callsUnicast))
+	assertEqual(t, dhcpv4.MessageTypeAck, responder1.callsUnicast[0].resp.MessageType())
+
+	// peer is down, all clients are answered
+	assertNoError(t, s1.HandleSubnet(&Subnet{
+		Subnet:      "10.1.1.0/24",
+		RangeFrom:   "10.1.1.100",
+		RangeTo:     "10.1.1.110",
+		LoadBalance: &LoadBalance{Role: LoadBalancePrimary, Split: 128, PeerDown: true},
+	}))
+	assertEqual(t, "10.1.1.101", runClient(fs1.handler, responder1, mac2).String())
+}
+
+func TestServer_Live(t *testing.T) {
+	fs := &FakeDHCPServer{exit: make(chan error, 1)}
+	factory := &FakeDHCPServerFactory{fakeDHCPServer: fs}
+	s := NewServer(ServerConfig{
+		DHCPv4ServerFactory: factory,
+		ResponderFactory:    &FakeResponderFactory{responder: NewFakeResponder()},
+	})
+	listen := &Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"}
+	assertNoError(t, s.HandleListen(listen))
+	waitFor(t, "serving", func() bool { return s.Ready() == nil })
+
+	// stopped listener exits as expected
+	s.StopListen(listen.Subnet)
+	waitFor(t, "exit", func() bool { return len(fs.exit) == 0 })
+	assertNoError(t, s.Live())
+	assertNoError(t, s.Ready())
+
+	// so do listeners of the closed server
+	assertNoError(t, s.HandleListen(listen))
+	waitFor(t, "serving", func() bool { return s.Ready() == nil })
+	s.Close()
+	waitFor(t, "exit", func() bool { return len(fs.exit) == 0 })
+	time.Sleep(time.Millisecond * 50)
+	assertNoError(t, s.Live())
+
+	assertNoError(t, s.HandleListen(listen))
+	waitFor(t, "serving", func() bool { return s.Ready() == nil })
+	fs.exit <- errors.New("interface is down")
+	waitFor(t, "unexpected exit", func() bool { return s.Live() != nil })
+	assertTrue(t, s.Ready() != nil)
+
+	// the new listener of the subnet clears the exit
+	factory.fakeDHCPServer = &FakeDHCPServer{exit: make(chan error, 1)}
+	assertNoError(t, s.HandleListen(listen))
+	assertNoError(t, s.Live())
+	waitFor(t, "serving", func() bool { return s.Ready() == nil })
+}
@@ -4,18 +4,43 @@ import (
 	"errors"
 	"fmt"
 	"github.com/insomniacslk/dhcp/dhcpv4"
+	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	defaultLeaseTime = 14400 //4 hours
+	defaultLeaseTime       = 14400 //4 hours
+	defaultDeclineHoldTime = 3600  //1 hour
+	defaultOfferHoldTime   = 60
+)
+
+// ErrUnknownClient is returned when the subnet has no lease for a client.
+var ErrUnknownClient = errors.New("unknown client")
+
+// ErrLeaseTaken is returned by lease storage when the address is held by a
+// client of another server.
+var ErrLeaseTaken = errors.New("address is leased by another server")
+
+// LeaseState tracks the lease from OFFER to ACK and until the address is freed.
+type LeaseState string
+
+const (
+	LeaseStateOffered  LeaseState = "offered"
+	LeaseStateBound    LeaseState = "bound"
+	LeaseStateExpired  LeaseState = "expired"
+	LeaseStateReleased LeaseState = "released"
+	LeaseStateDeclined LeaseState = "declined"
 )
 
 type Lease struct {
+	Subnet    string   `json:"subnet"`
+	Host      string   `json:"host,omitempty"`
 	MAC       string   `json:"mac"`
+	ClientID  string   `json:"clientId,omitempty"`
 	IP        string   `json:"ip"`
 	NetMask   string   `json:"netMask"`
 	Gateway   string   `json:"gateway,omitempty"`
@@ -23,7 +48,8 @@ type Lease struct {
 	Options   []Option `json:"options,omitempty"`
 	LeaseTime int      `json:"leaseTime,omitempty"`
 
-	LastUpdate time.Time `json:"lastUpdate"`
+	State      LeaseState `json:"state,omitempty"`
+	LastUpdate time.Time  `json:"lastUpdate"`
 }
 
 type Subnet struct {
@@ -34,13 +60,62 @@ type Subnet struct {
 	DNS       []string `json:"dns"`
 	Options   []Option `json:"options"`
 	LeaseTime int      `json:"leaseTime"`
+	// DeclineHoldTime is how long (in seconds) a declined address stays quarantined.
+	DeclineHoldTime int `json:"declineHoldTime"`
+	// OfferHoldTime is how long (in seconds) an offered address is reserved waiting for REQUEST.
+	OfferHoldTime int `json:"offerHoldTime"`
+	// ServerID overrides the server identifier (option 54), which is the listener address by default.
+	ServerID string `json:"serverId,omitempty"`
+	// CircuitIDs and RemoteIDs select the subnet for clients behind these relay agent ports.
+	CircuitIDs []string `json:"circuitIds,omitempty"`
+	RemoteIDs  []string `json:"remoteIds,omitempty"`
+	// Allocator selects how free addresses are found, see AllocatorBitmap and AllocatorWalk.
+	Allocator string `json:"allocator,omitempty"`
+	// LeaseKey selects how leases are matched to clients, see LeaseKeyChaddr,
+	// LeaseKeyClientID and LeaseKeyBoth.
+	LeaseKey string `json:"leaseKey,omitempty"`
+	// LoadBalance splits the clients between this server and its peer.
+	LoadBalance *LoadBalance `json:"loadBalance,omitempty"`
+
+	iPFrom  IPv4
+	iPTo    IPv4
+	ipNet   net.IPNet
+	netMask string
+
+	// mu guards the leases and host reservations below, since listeners
+	// handle clients concurrently.
+	mu *sync.Mutex
+	// replacedBy is the reconfigured subnet which took over the leases.
+	replacedBy *Subnet
+	alloc      Allocator
+	leases     *LeaseStore
+	hosts      map[string]*Host
+	reserved   map[IPv4]string
+	// pool restricts allocation to the addresses owned in the failover
+	// relationship, nil without failover.
+	pool *failoverPool
+	// peerAlloc keeps track of the addresses owned by the failover peer,
+	// which are allocated in PARTNER-DOWN state only. Their leases are
+	// tracked MCLT longer, since the peer may have extended them meanwhile.
+	// Every address is held in the allocator of the other server.
+	peerAlloc Allocator
+	// free are the addresses of the server without a lease, which may be
+	// transferred to the failover peer.
+	free map[IPv4]bool
+}
 
-	iPFrom     IPv4
-	iPTo       IPv4
-	ipNet      net.IPNet
-	currentIP  IPv4
-	leaseCache map[string]*Lease
-	netMask    string
+// lock locks and returns the current version of the subnet. Requests which
+// found the subnet before it was reconfigured must not change the leases left
+// behind, so they follow the chain of replacements.
+func (s *Subnet) lock() *Subnet {
+	s.mu.Lock()
+	for s.replacedBy != nil {
+		next := s.replacedBy
+		s.mu.Unlock()
+		s = next
+		s.mu.Lock()
+	}
+	return s
 }
 
 func (s *Subnet) Contains(ip net.IP) bool {
@@ -60,10 +135,39 @@ func InitializeSubnet(subnet *Subnet) (*Subnet, error) {
 	if subnet.iPFrom > subnet.iPTo {
 		return nil, errors.New("from > to")
 	}
-	subnet.leaseCache = make(map[string]*Lease)
+	switch subnet.LeaseKey {
+	case "":
+		subnet.LeaseKey = LeaseKeyChaddr
+	case LeaseKeyChaddr, LeaseKeyClientID, LeaseKeyBoth:
+	default:
+		return nil, fmt.Errorf("unknown lease key %q", subnet.LeaseKey)
+	}
+	if subnet.LoadBalance != nil {
+		err = subnet.LoadBalance.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	subnet.mu = &sync.Mutex{}
+	subnet.alloc, err = newAllocator(subnet.Allocator, subnet.iPFrom, subnet.iPTo)
+	if err != nil {
+		return nil, err
+	}
+	subnet.leases = NewLeaseStore(subnet.LeaseKey)
+	subnet.hosts = make(map[string]*Host)
+	subnet.reserved = make(map[IPv4]string)
+	if subnet.LeaseTime < 0 || subnet.OfferHoldTime < 0 || subnet.DeclineHoldTime < 0 {
+		return nil, fmt.Errorf("subnet %s: lease and hold times must not be negative", subnet.Subnet)
+	}
 	if subnet.LeaseTime == 0 {
 		subnet.LeaseTime = defaultLeaseTime
 	}
+	if subnet.DeclineHoldTime == 0 {
+		subnet.DeclineHoldTime = defaultDeclineHoldTime
+	}
+	if subnet.OfferHoldTime == 0 {
+		subnet.OfferHoldTime = defaultOfferHoldTime
+	}
 	sn := strings.Split(subnet.Subnet, "/")
 	if len(sn) != 2 {
 		return nil, fmt.Errorf("invalid subnet %q (%v)", subnet.Subnet, subnet)
@@ -79,70 +183,461 @@ func InitializeSubnet(subnet *Subnet) (*Subnet, error) {
 		Mask: ipMask,
 	}
 	subnet.netMask = net.IP(ipMask).String()
+	if subnet.ServerID != "" && net.ParseIP(subnet.ServerID).To4() == nil {
+		return nil, fmt.Errorf("invalid server id %q", subnet.ServerID)
+	}
+	for _, opt := range subnet.Options {
+		err = opt.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
 	return subnet, nil
 }
 
-func (s *Subnet) incrementCurrentIP() {
-	s.currentIP.Inc()
-	if s.currentIP > s.iPTo {
-		s.currentIP = s.iPFrom
+func (s *Subnet) GetLeaseForMAC(req *dhcpv4.DHCPv4) *Lease {
+	s = s.lock()
+	defer s.mu.Unlock()
+	return s.getLeaseForMAC(req)
+}
+
+// leaseFor allocates the lease for req like GetLeaseForMAC and binds it if
+// bind is set. It returns a copy which is safe to use without the lock and,
+// if bound, a copy of the lease before for restoreLease.
+func (s *Subnet) leaseFor(req *dhcpv4.DHCPv4, bind bool) (*Lease, *Lease) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	lease := s.getLeaseForMAC(req)
+	if lease == nil {
+		return nil, nil
+	}
+	var before *Lease
+	if bind {
+		leaseCopy := *lease
+		before = &leaseCopy
+		s.bindLease(lease)
 	}
+	leaseCopy := *lease
+	return &leaseCopy, before
 }
 
-func (s *Subnet) GetLeaseForMAC(req *dhcpv4.DHCPv4) *Lease {
-	var (
-		lease       *Lease
-		oldestLease *Lease
-		ok          bool
-	)
-	mac := req.ClientHWAddr.String()
-	lease, ok = s.leaseCache[mac]
-	if ok {
+// restoreLease puts back the lease as it was before binding failed to be
+// stored, so the address is not held by a lease nobody knows about.
+func (s *Subnet) restoreLease(before *Lease) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	cached := s.leases.ByIP(before.IP)
+	if cached == nil || cached.MAC != before.MAC || cached.ClientID != before.ClientID {
+		return
+	}
+	*cached = *before
+	s.leases.Put(cached)
+	s.track(cached)
+}
+
+// copyLease returns a copy of the cached lease which is safe to use without the lock.
+func (s *Subnet) copyLease(lease *Lease) *Lease {
+	s = s.lock()
+	defer s.mu.Unlock()
+	leaseCopy := *lease
+	return &leaseCopy
+}
+
+func (s *Subnet) getLeaseForMAC(req *dhcpv4.DHCPv4) *Lease {
+	c := clientKeyOf(req)
+	if host := s.findHost(req); host != nil {
+		return s.hostLease(host, c)
+	}
+	lease := s.clientLease(c)
+	if lease != nil {
+		if lease.State == LeaseStateOffered {
+			s.refreshOffer(lease)
+		}
 		return lease
 	}
 
-	//TODO: check requested address
-
-	if s.currentIP == 0 {
-		s.currentIP = s.iPFrom
-	} else {
-		s.incrementCurrentIP()
-	}
-	expiredTime := time.Now().Add(-time.Second * time.Duration(s.LeaseTime))
-	firstIp := s.currentIP
-	for {
-		lease, ok = s.leaseCache[s.currentIP.String()]
-		if !ok {
-			lease = &Lease{
-				IP:         s.currentIP.String(),
-				LastUpdate: time.Now(),
-				Options:    s.Options,
-				NetMask:    s.netMask,
-				Gateway:    s.Gateway,
-				DNS:        s.DNS,
-				LeaseTime:  s.LeaseTime,
-			}
-			s.leaseCache[lease.IP] = lease
-			s.leaseCache[mac] = lease
-			return lease
+	lease = s.requestedLease(req, c)
+	if lease != nil {
+		return lease
+	}
+
+	ip, ok := s.allocate(time.Now())
+	if !ok {
+		return nil
+	}
+	if lease = s.leases.ByIP(ip.String()); lease != nil {
+		s.expireLease(lease)
+	}
+	return s.newLease(ip, c)
+}
+
+// allocate takes a free address of the server, or of the failover peer in
+// PARTNER-DOWN state.
+func (s *Subnet) allocate(now time.Time) (IPv4, bool) {
+	ip, ok := s.alloc.Allocate(now)
+	if ok || !s.pool.takesOver(now) {
+		return ip, ok
+	}
+	return s.peerAlloc.Allocate(now)
+}
+
+// clientLease returns the lease of client c according to LeaseKey.
+func (s *Subnet) clientLease(c clientKey) *Lease {
+	return s.leases.ByClient(c)
+}
+
+// owns reports whether lease belongs to client c according to LeaseKey.
+func (s *Subnet) owns(lease *Lease, c clientKey) bool {
+	switch s.LeaseKey {
+	case LeaseKeyClientID:
+		if c.id != "" {
+			return lease.ClientID == c.id
+		}
+		return lease.ClientID == "" && lease.MAC == c.mac
+	case LeaseKeyBoth:
+		return lease.ClientID == c.id && lease.MAC == c.mac
+	default:
+		return lease.MAC == c.mac
+	}
+}
+
+// requestedLease allocates the address requested with option 50 or ciaddr,
+// if it is in range and free.
+func (s *Subnet) requestedLease(req *dhcpv4.DHCPv4, c clientKey) *Lease {
+	ip := req.RequestedIPAddress()
+	if ip == nil {
+		ip = req.ClientIPAddr
+	}
+	if ip == nil || ip.To4() == nil || ip.IsUnspecified() {
+		return nil
+	}
+	addr, err := ParseIPv4(ip.To4().String())
+	if err != nil || addr < s.iPFrom || addr > s.iPTo || s.isReserved(addr) {
+		return nil
+	}
+	lease := s.leases.ByIP(addr.String())
+	if !s.canAllocate(addr, lease, time.Now()) {
+		return nil
+	}
+	if lease != nil {
+		s.expireLease(lease)
+	}
+	return s.newLease(addr, c)
+}
+
+// canAllocate reports whether the server may give ip, leased by lease if not
+// nil, to a new client at now. Addresses of the failover peer are taken over
+// in PARTNER-DOWN state MCLT after their leases expired.
+func (s *Subnet) canAllocate(ip IPv4, lease *Lease, now time.Time) bool {
+	if s.pool.owns(ip) {
+		return lease == nil || s.isExpired(lease, now)
+	}
+	if !s.pool.takesOver(now) {
+		return false
+	}
+	return lease == nil || s.expiry(lease).Add(s.pool.mclt).Before(now)
+}
+
+// expireLease marks lease expired before its address is given to another
+// client. The store drops it when the new lease is put.
+func (s *Subnet) expireLease(lease *Lease) {
+	if lease.State == LeaseStateBound {
+		lease.State = LeaseStateExpired
+	}
+}
+
+func (s *Subnet) newLease(ip IPv4, c clientKey) *Lease {
+	lease := &Lease{
+		Subnet:     s.Subnet,
+		MAC:        c.mac,
+		ClientID:   c.id,
+		IP:         ip.String(),
+		LastUpdate: time.Now(),
+		Options:    s.Options,
+		NetMask:    s.netMask,
+		Gateway:    s.Gateway,
+		DNS:        s.DNS,
+		State:      LeaseStateOffered,
+	}
+	lease.LeaseTime = s.leaseTime(ip, lease.LastUpdate)
+	s.leases.Put(lease)
+	s.track(lease)
+	return lease
+}
+
+// refreshOffer holds the offered address again for the client repeating DISCOVER.
+func (s *Subnet) refreshOffer(lease *Lease) {
+	lease.LastUpdate = time.Now()
+	if s.pool != nil {
+		lease.LeaseTime = s.leaseTime(s.leaseIP(lease), lease.LastUpdate)
+	}
+	s.track(lease)
+}
+
+// leaseTime returns the lease time of ip given at now. With failover, leases
+// expire at most MCLT after the expiry acknowledged by the peer, so the peer
+// taking over the address knows how long to wait for it.
+func (s *Subnet) leaseTime(ip IPv4, now time.Time) int {
+	if s.pool == nil {
+		return s.LeaseTime
+	}
+	maxLeaseTime := int(s.pool.maxExpiry(ip, now).Sub(now) / time.Second)
+	if maxLeaseTime < s.LeaseTime {
+		return maxLeaseTime
+	}
+	return s.LeaseTime
+}
+
+// leaseIP returns the address of a cached lease, which is always valid.
+func (s *Subnet) leaseIP(lease *Lease) IPv4 {
+	ip, _ := ParseIPv4(lease.IP)
+	return ip
+}
+
+// track passes the expiry of lease to the allocator of the server owning its
+// address. Reserved addresses are held as long as the reservation exists.
+func (s *Subnet) track(lease *Lease) {
+	ip, err := ParseIPv4(lease.IP)
+	if err != nil {
+		return
+	}
+	if s.isReserved(ip) {
+		s.hold(ip)
+		return
+	}
+	delete(s.free, ip)
+	if s.pool.owns(ip) {
+		s.alloc.Use(ip, s.expiry(lease))
+		return
+	}
+	s.peerAlloc.Use(ip, s.expiry(lease).Add(s.pool.mclt))
+}
+
+// freeAddress returns ip to the allocator of the server owning it unless it
+// is reserved.
+func (s *Subnet) freeAddress(ip string) {
+	addr, err := ParseIPv4(ip)
+	if err != nil || s.isReserved(addr) {
+		return
+	}
+	s.ownerAlloc(addr).Free(addr)
+	if s.pool != nil && s.pool.owns(addr) {
+		s.free[addr] = true
+	}
+}
+
+// ownerAlloc returns the allocator of the server or the failover peer owning ip.
+func (s *Subnet) ownerAlloc(ip IPv4) Allocator {
+	if s.pool.owns(ip) {
+		return s.alloc
+	}
+	return s.peerAlloc
+}
+
+// hold keeps ip from being allocated for the server and the failover peer.
+func (s *Subnet) hold(ip IPv4) {
+	s.alloc.Use(ip, time.Time{})
+	if s.peerAlloc != nil {
+		s.peerAlloc.Use(ip, time.Time{})
+	}
+}
+
+// isExpired reports whether the address of lease may be given to another client.
+func (s *Subnet) isExpired(lease *Lease, now time.Time) bool {
+	switch lease.State {
+	case LeaseStateExpired, LeaseStateReleased:
+		return true
+	}
+	return s.expiry(lease).Before(now)
+}
+
+// expiry returns the time the address of lease is free after. Offered and
+// declined addresses are held for OfferHoldTime and DeclineHoldTime, bound
+// ones for the lease time.
+func (s *Subnet) expiry(lease *Lease) time.Time {
+	var ttl int
+	switch lease.State {
+	case LeaseStateOffered:
+		ttl = s.OfferHoldTime
+	case LeaseStateDeclined:
+		ttl = s.DeclineHoldTime
+	case LeaseStateExpired, LeaseStateReleased:
+		return lease.LastUpdate
+	default:
+		ttl = lease.LeaseTime
+		if ttl == 0 {
+			ttl = s.LeaseTime
 		}
-		//TODO: check for ACK
-		if lease.LastUpdate.Before(expiredTime) {
-			if oldestLease == nil {
-				oldestLease = lease
-			} else {
-				if oldestLease.LastUpdate.After(lease.LastUpdate) {
-					oldestLease = lease
-				}
-			}
+	}
+	return lease.LastUpdate.Add(time.Second * time.Duration(ttl))
+}
+
+// CheckLease verifies that ip may be acknowledged to mac, which has no client identifier.
+func (s *Subnet) CheckLease(mac net.HardwareAddr, ip net.IP) error {
+	return s.checkLease(clientKey{mac: mac.String()}, ip)
+}
+
+func (s *Subnet) checkLease(c clientKey, ip net.IP) error {
+	s = s.lock()
+	defer s.mu.Unlock()
+	lease := s.leases.ByIP(ip.String())
+	if lease != nil && !s.owns(lease, c) && (lease.State == LeaseStateDeclined || !s.isExpired(lease, time.Now())) {
+		return fmt.Errorf("%s is leased to another client", ip)
+	}
+	lease = s.clientLease(c)
+	if lease == nil {
+		return fmt.Errorf("%w %s", ErrUnknownClient, c)
+	}
+	if lease.IP != ip.String() {
+		return fmt.Errorf("%s does not match lease %s", ip, lease.IP)
+	}
+	return nil
+}
+
+// adoptLeases takes over the leases and hosts of old, which is replaced by s. Leases
+// outside of the new subnet are dropped, the rest get the new options.
+// Leases are copied, since requests in flight may still update them in old.
+func (s *Subnet) adoptLeases(old *Subnet) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// requests holding old go on in s from now on
+	old.replacedBy = s
+	for _, host := range old.hosts {
+		err := s.addHost(host)
+		if err != nil {
+			log.Printf("dropping host reservation: %s", err)
 		}
-		s.incrementCurrentIP()
-		if firstIp == s.currentIP {
-			if oldestLease != nil {
-				return oldestLease
-			} else {
-				return nil
-			}
+	}
+	old.leases.Each(func(lease *Lease) {
+		if !s.Contains(net.ParseIP(lease.IP)) {
+			return
 		}
+		leaseCopy := *lease
+		leaseCopy.Options = s.optionsFor(lease.Host)
+		leaseCopy.NetMask = s.netMask
+		leaseCopy.Gateway = s.Gateway
+		leaseCopy.DNS = s.DNS
+		s.leases.Put(&leaseCopy)
+		s.track(&leaseCopy)
+	})
+}
+
+// dropLease forgets the lease after another server took its address. The
+// address stays used until the lease of the other server comes from storage.
+func (s *Subnet) dropLease(lease *Lease) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	cached := s.leases.ByIP(lease.IP)
+	if cached != nil && cached.MAC == lease.MAC && cached.ClientID == lease.ClientID {
+		s.leases.Delete(cached)
+	}
+	ip, err := ParseIPv4(lease.IP)
+	if err != nil || s.isReserved(ip) {
+		return
+	}
+	delete(s.free, ip)
+	s.ownerAlloc(ip).Use(ip, time.Now().Add(time.Second*time.Duration(s.OfferHoldTime)))
+}
+
+// removeLease forgets the lease of ip removed from storage.
+func (s *Subnet) removeLease(ip string) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	lease := s.leases.ByIP(ip)
+	if lease == nil {
+		return
+	}
+	s.leases.Delete(lease)
+	s.freeAddress(ip)
+}
+
+// AddLease puts a lease restored from storage into the cache.
+func (s *Subnet) AddLease(lease *Lease) error {
+	s = s.lock()
+	defer s.mu.Unlock()
+	if !s.Contains(net.ParseIP(lease.IP)) {
+		return fmt.Errorf("lease %s is not in subnet %s", lease.IP, s.Subnet)
+	}
+	if lease.State == "" {
+		lease.State = LeaseStateBound
+	}
+	lease.Subnet = s.Subnet
+	s.leases.Put(lease)
+	s.track(lease)
+	return nil
+}
+
+// BindLease marks lease bound after the client REQUEST is acknowledged.
+func (s *Subnet) BindLease(lease *Lease) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	s.bindLease(lease)
+}
+
+func (s *Subnet) bindLease(lease *Lease) {
+	lease.State = LeaseStateBound
+	lease.LastUpdate = time.Now()
+	if s.pool != nil {
+		lease.LeaseTime = s.leaseTime(s.leaseIP(lease), lease.LastUpdate)
+	}
+	s.track(lease)
+}
+
+// ReleaseLease removes the lease for ip from the cache, so the address can be
+// allocated again. The lease must belong to mac.
+func (s *Subnet) ReleaseLease(mac net.HardwareAddr, ip net.IP) (*Lease, error) {
+	return s.releaseLease(clientKey{mac: mac.String()}, ip)
+}
+
+func (s *Subnet) releaseLease(c clientKey, ip net.IP) (*Lease, error) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	lease := s.leases.ByIP(ip.String())
+	if lease == nil {
+		return nil, fmt.Errorf("lease for %s not found", ip)
+	}
+	if !s.owns(lease, c) {
+		return nil, fmt.Errorf("lease for %s belongs to %s, not %s", ip, lease.MAC, c)
+	}
+	s.leases.Delete(lease)
+	s.freeAddress(lease.IP)
+	lease.State = LeaseStateReleased
+	lease.LastUpdate = time.Now()
+	return lease, nil
+}
+
+// DeclineLease quarantines ip after mac reported it as already in use. The
+// address is not allocated again until DeclineHoldTime passes.
+func (s *Subnet) DeclineLease(mac net.HardwareAddr, ip net.IP) (*Lease, error) {
+	return s.declineLease(clientKey{mac: mac.String()}, ip)
+}
+
+func (s *Subnet) declineLease(c clientKey, ip net.IP) (*Lease, error) {
+	s = s.lock()
+	defer s.mu.Unlock()
+	addr, err := ParseIPv4(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	if addr < s.iPFrom || addr > s.iPTo {
+		return nil, fmt.Errorf("declined address %s is out of range %s-%s", ip, s.RangeFrom, s.RangeTo)
+	}
+	lease := s.leases.ByIP(addr.String())
+	if lease != nil && !s.owns(lease, c) && !s.isExpired(lease, time.Now()) {
+		return nil, fmt.Errorf("lease for %s belongs to %s, not %s", ip, lease.MAC, c)
+	}
+	if lease == nil {
+		lease = &Lease{Subnet: s.Subnet, IP: addr.String()}
 	}
+	lease.MAC = c.mac
+	lease.ClientID = c.id
+	lease.State = LeaseStateDeclined
+	// the record of the declined address lives as long as the quarantine
+	lease.LeaseTime = s.DeclineHoldTime
+	lease.LastUpdate = time.Now()
+	s.leases.Put(lease)
+	s.track(lease)
+	return lease, nil
 }
@@ -3,7 +3,9 @@ package dhcp
 import (
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"log"
+	"net"
 	"testing"
+	"time"
 )
 
 func assertTrue(t *testing.T, b bool) {
@@ -27,6 +29,12 @@ func assertEqual(t *testing.T, expected interface{}, actual interface{}) {
 	}
 }
 
+// ageLease moves the last update of a cached lease d back in time.
+func ageLease(s *Subnet, lease *Lease, d time.Duration) {
+	lease.LastUpdate = time.Now().Add(-d)
+	s.track(lease)
+}
+
 func TestSubnet_GetLeaseForMAC(t *testing.T) {
 	s := &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.3"}
 	_, err := InitializeSubnet(s)
@@ -42,3 +50,149 @@ func TestSubnet_GetLeaseForMAC(t *testing.T) {
 	l4 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 04}})
 	assertTrue(t, l4 == nil)
 }
+
+func TestSubnet_ReleaseLease(t *testing.T) {
+	s := &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.3"}
+	_, err := InitializeSubnet(s)
+	assertNoError(t, err)
+	for i := byte(1); i <= 3; i++ {
+		s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, i}})
+	}
+	_, err = s.ReleaseLease([]byte{00, 00, 00, 00, 00, 01}, net.ParseIP("10.1.1.2"))
+	assertTrue(t, err != nil)
+	lease, err := s.ReleaseLease([]byte{00, 00, 00, 00, 00, 02}, net.ParseIP("10.1.1.2"))
+	assertNoError(t, err)
+	assertEqual(t, LeaseStateReleased, lease.State)
+	l4 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 04}})
+	assertEqual(t, "10.1.1.2", l4.IP)
+}
+
+func TestSubnet_DeclineLease(t *testing.T) {
+	s := &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.2", DeclineHoldTime: 60}
+	_, err := InitializeSubnet(s)
+	assertNoError(t, err)
+	l1 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 01}})
+	assertEqual(t, "10.1.1.1", l1.IP)
+	_, err = s.DeclineLease([]byte{00, 00, 00, 00, 00, 02}, net.ParseIP("10.1.1.1"))
+	assertTrue(t, err != nil)
+	_, err = s.DeclineLease([]byte{00, 00, 00, 00, 00, 01}, net.ParseIP("10.1.1.9"))
+	assertTrue(t, err != nil)
+	lease, err := s.DeclineLease([]byte{00, 00, 00, 00, 00, 01}, net.ParseIP("10.1.1.1"))
+	assertNoError(t, err)
+	assertEqual(t, LeaseStateDeclined, lease.State)
+	assertEqual(t, "00:00:00:00:00:01", lease.MAC)
+
+	l1 = s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 01}})
+	assertEqual(t, "10.1.1.2", l1.IP)
+	l3 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 03}})
+	assertTrue(t, l3 == nil)
+
+	ageLease(s, lease, time.Minute*2)
+	l3 = s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 03}})
+	assertEqual(t, "10.1.1.1", l3.IP)
+	assertEqual(t, "00:00:00:00:00:03", l3.MAC)
+}
+
+func TestSubnet_GetLeaseForMAC_RequestedIP(t *testing.T) {
+	s := &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.5"}
+	_, err := InitializeSubnet(s)
+	assertNoError(t, err)
+	newReq := func(mac byte, ip string) *dhcpv4.DHCPv4 {
+		req := &dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, mac}}
+		req.UpdateOption(dhcpv4.OptRequestedIPAddress(net.ParseIP(ip)))
+		return req
+	}
+	l1 := s.GetLeaseForMAC(newReq(1, "10.1.1.4"))
+	assertEqual(t, "10.1.1.4", l1.IP)
+	// already assigned
+	l2 := s.GetLeaseForMAC(newReq(2, "10.1.1.4"))
+	assertEqual(t, "10.1.1.1", l2.IP)
+	// out of range
+	l3 := s.GetLeaseForMAC(newReq(3, "10.1.1.200"))
+	assertEqual(t, "10.1.1.2", l3.IP)
+	// ciaddr
+	l4 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 04}, ClientIPAddr: net.ParseIP("10.1.1.5")})
+	assertEqual(t, "10.1.1.5", l4.IP)
+	// quarantined
+	_, err = s.DeclineLease([]byte{00, 00, 00, 00, 00, 01}, net.ParseIP("10.1.1.4"))
+	assertNoError(t, err)
+	l5 := s.GetLeaseForMAC(newReq(5, "10.1.1.4"))
+	assertEqual(t, "10.1.1.3", l5.IP)
+	// expired
+	ageLease(s, s.leases.ByIP("10.1.1.4"), time.Hour*2)
+	l6 := s.GetLeaseForMAC(newReq(6, "10.1.1.4"))
+	assertEqual(t, "10.1.1.4", l6.IP)
+}
+
+func TestSubnet_LeaseStates(t *testing.T) {
+	s := &Subnet{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.2", OfferHoldTime: 10}
+	_, err := InitializeSubnet(s)
+	assertNoError(t, err)
+	l1 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 01}})
+	assertEqual(t, LeaseStateOffered, l1.State)
+	l2 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 02}})
+	s.BindLease(l2)
+	assertEqual(t, LeaseStateBound, l2.State)
+	l3 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 03}})
+	assertTrue(t, l3 == nil)
+
+	// offer is not confirmed within OfferHoldTime
+	ageLease(s, l1, time.Second*11)
+	ageLease(s, l2, time.Second*11)
+	l3 = s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 03}})
+	assertEqual(t, "10.1.1.1", l3.IP)
+	assertEqual(t, LeaseStateOffered, l3.State)
+	assertTrue(t, s.leases.ByMAC("00:00:00:00:00:01") == nil)
+
+	// bound lease expires after the lease time
+	ageLease(s, l2, time.Second*time.Duration(s.LeaseTime+1))
+	l4 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 04}})
+	assertEqual(t, "10.1.1.2", l4.IP)
+	assertEqual(t, LeaseStateExpired, l2.State)
+}
+
+func TestSubnet_Hosts(t *testing.T) {
+	s := &Subnet{
+		Subnet:    "10.1.1.0/24",
+		RangeFrom: "10.1.1.1",
+		RangeTo:   "10.1.1.3",
+		Options:   []Option{{ID: 66, Type: "string", Value: "tftp"}, {ID: 67, Type: "string", Value: "boot.pxe"}},
+	}
+	_, err := InitializeSubnet(s)
+	assertNoError(t, err)
+	host, err := InitializeHost(&Host{
+		MAC:     "00:00:00:00:00:01",
+		IPv4:    "10.1.1.2",
+		Options: []Option{{ID: 67, Type: "string", Value: "boot-1.pxe"}},
+	})
+	assertNoError(t, err)
+	assertNoError(t, s.AddHost(host))
+	err = s.AddHost(&Host{MAC: "00:00:00:00:00:02", IPv4: "10.1.1.2", ip: host.ip})
+	assertTrue(t, err != nil)
+
+	l2 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 02}})
+	assertEqual(t, "10.1.1.1", l2.IP)
+	l1 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 01}})
+	assertEqual(t, "10.1.1.2", l1.IP)
+	assertEqual(t, 2, len(l1.Options))
+	assertEqual(t, "tftp", l1.Options[0].Value)
+	assertEqual(t, "boot-1.pxe", l1.Options[1].Value)
+	l3 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 03}})
+	assertEqual(t, "10.1.1.3", l3.IP)
+	l4 := s.GetLeaseForMAC(&dhcpv4.DHCPv4{ClientHWAddr: []byte{00, 00, 00, 00, 00, 04}})
+	assertTrue(t, l4 == nil)
+
+	s.RemoveHost("00:00:00:00:00:01")
+	assertTrue(t, !s.isReserved(host.ip))
+}
+
+func TestInitializeSubnet_NegativeTimes(t *testing.T) {
+	for _, s := range []*Subnet{
+		{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.3", LeaseTime: -1},
+		{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.3", OfferHoldTime: -1},
+		{Subnet: "10.1.1.0/24", RangeFrom: "10.1.1.1", RangeTo: "10.1.1.3", DeclineHoldTime: -1},
+	} {
+		_, err := InitializeSubnet(s)
+		assertTrue(t, err != nil)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/bmcgo/dhcpgo/dhcp"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -11,6 +12,7 @@ import (
 type DhcpgoClient interface {
 	PutListen(context.Context, dhcp.Listen) error
 	PutSubnet(context.Context, dhcp.Subnet) error
+	PutHost(context.Context, dhcp.Host) error
 }
 
 type DhcpgoTool struct {
@@ -39,7 +41,7 @@ func (c *DhcpgoTool) Configure(args []string) error {
 }
 
 func (c *DhcpgoTool) configureListen(args []string) error {
-	// if=eth0,laddr=192.168.1.1,subnet=192.168.1.0/24
+	// if=eth0,laddr=192.168.1.1,subnet=192.168.1.0/24,vlan=100
 	if len(args) != 1 {
 		return fmt.Errorf("invalid args %v", args)
 	}
@@ -54,6 +56,12 @@ func (c *DhcpgoTool) configureListen(args []string) error {
 			listen.Laddr = keyVal[1]
 		case "subnet":
 			listen.Subnet = keyVal[1]
+		case "vlan":
+			vlan, err := strconv.ParseUint(keyVal[1], 10, 12)
+			if err != nil || vlan == 0 {
+				return fmt.Errorf("invalid vlan %q", keyVal[1])
+			}
+			listen.VLAN = uint16(vlan)
 		default:
 			return fmt.Errorf("invalid args %v", args)
 		}
@@ -62,7 +70,11 @@ func (c *DhcpgoTool) configureListen(args []string) error {
 }
 
 func (c *DhcpgoTool) configureSubnet(args []string) error {
-	// 10.1.1.0/24 10.1.1.10-10.1.1.99 gw=10.1.1.1,dns=10.1.1.1,dns=10.2.1.1,option-67=string:boot.pxe,option-66=string:10.12.1.1
+	// 10.1.1.0/24 10.1.1.10-10.1.1.99 gw=10.1.1.1,dns=10.1.1.1,dns=10.2.1.1,decline-hold=3600,allocator=bitmap,lease-key=client-id,lb-role=primary,lb-split=128,option-67=string:boot.pxe,option-66=string:10.12.1.1
+	// option types: string, ip, ip-list, uint8, uint16, uint32, bool, hex, domain-search, routes, base64
+	// option-42=ip-list:10.1.1.1,10.2.1.1,option-121=routes:10.0.0.0/8-10.1.1.1
+	// registered options are accepted by name and type may be omitted: ntp-servers=10.1.1.1,bootfile-name=boot.pxe
+	// load balancing with a peer (RFC 3074): lb-role=primary|secondary,lb-split=0-256,lb-peer-down=true
 	if len(args) != 3 {
 		//TODO: print usage
 		return fmt.Errorf("invalid args %v", args)
@@ -84,37 +96,169 @@ func (c *DhcpgoTool) configureSubnet(args []string) error {
 	subnet.RangeFrom = ipRange[0]
 	subnet.RangeTo = ipRange[1]
 
-	for _, bit := range strings.Split(args[2], ",") {
-		nameVal := strings.Split(bit, "=")
+	params, err := splitParams(args[2])
+	if err != nil {
+		return err
+	}
+	for _, nameVal := range params {
 		switch nameVal[0] {
 		case "gw":
 			subnet.Gateway = nameVal[1]
 		case "dns":
-			subnet.DNS = append(subnet.DNS, nameVal[1])
+			subnet.DNS = append(subnet.DNS, strings.Split(nameVal[1], ",")...)
+		case "circuit-id":
+			subnet.CircuitIDs = append(subnet.CircuitIDs, nameVal[1])
+		case "remote-id":
+			subnet.RemoteIDs = append(subnet.RemoteIDs, nameVal[1])
+		case "server-id":
+			if net.ParseIP(nameVal[1]).To4() == nil {
+				return fmt.Errorf("invalid server id %q", nameVal[1])
+			}
+			subnet.ServerID = nameVal[1]
+		case "offer-hold":
+			holdTime, err := strconv.Atoi(nameVal[1])
+			if err != nil || holdTime < 0 {
+				return fmt.Errorf("invalid offer hold time %q", nameVal[1])
+			}
+			if holdTime == 0 {
+				// zero is stored as unset and the default hold time applies
+				return fmt.Errorf("offer hold time must be at least 1 second")
+			}
+			subnet.OfferHoldTime = holdTime
+		case "decline-hold":
+			holdTime, err := strconv.Atoi(nameVal[1])
+			if err != nil || holdTime < 0 {
+				return fmt.Errorf("invalid decline hold time %q", nameVal[1])
+			}
+			if holdTime == 0 {
+				// zero is stored as unset and the default hold time applies
+				return fmt.Errorf("decline hold time must be at least 1 second")
+			}
+			subnet.DeclineHoldTime = holdTime
+		case "allocator":
+			subnet.Allocator = nameVal[1]
+		case "lease-key":
+			subnet.LeaseKey = nameVal[1]
+		case "lb-role":
+			loadBalance(&subnet).Role = nameVal[1]
+		case "lb-split":
+			split, err := strconv.Atoi(nameVal[1])
+			if err != nil || split < 0 || split > 256 {
+				return fmt.Errorf("invalid load balancing split %q", nameVal[1])
+			}
+			loadBalance(&subnet).Split = split
+		case "lb-peer-down":
+			down, err := strconv.ParseBool(nameVal[1])
+			if err != nil {
+				return fmt.Errorf("invalid load balancing peer down %q", nameVal[1])
+			}
+			loadBalance(&subnet).PeerDown = down
 		default:
-			if strings.HasPrefix(nameVal[0], "option-") {
-				num, err := strconv.ParseInt(nameVal[0][7:], 10, 8)
+			if isOption(nameVal[0]) {
+				opt, err := dhcp.ParseOption(nameVal[0], nameVal[1])
 				if err != nil {
-					return fmt.Errorf("invalid option %s", nameVal)
-				}
-				typeVal := strings.Split(nameVal[1], ":")
-				if len(typeVal) != 2 {
-					return fmt.Errorf("invalid option %s", nameVal)
+					return err
 				}
-				subnet.Options = append(subnet.Options, dhcp.Option{
-					ID:    uint8(num),
-					Type:  typeVal[0],
-					Value: typeVal[1],
-				})
+				subnet.Options = append(subnet.Options, opt)
 				continue
 			}
+			return fmt.Errorf("invalid parameter %q", nameVal[0])
 		}
 	}
 
 	return c.client.PutSubnet(c.ctx, subnet)
 }
 
+// loadBalance returns the load balancing config of subnet, which is created
+// by the first lb- parameter.
+func loadBalance(subnet *dhcp.Subnet) *dhcp.LoadBalance {
+	if subnet.LoadBalance == nil {
+		subnet.LoadBalance = &dhcp.LoadBalance{}
+	}
+	return subnet.LoadBalance
+}
+
+// splitParams splits "gw=10.1.1.1,option-6=ip-list:10.1.1.1,10.2.1.1" into name
+// and value pairs. Items without "=" continue the list value of the previous one.
+func splitParams(s string) ([][]string, error) {
+	params := make([][]string, 0)
+	for _, bit := range strings.Split(s, ",") {
+		nameVal := strings.SplitN(bit, "=", 2)
+		if len(nameVal) == 2 {
+			params = append(params, nameVal)
+			continue
+		}
+		if len(params) == 0 {
+			return nil, fmt.Errorf("invalid parameter %q", bit)
+		}
+		params[len(params)-1][1] += "," + bit
+	}
+	return params, nil
+}
+
+func isOption(name string) bool {
+	_, ok := dhcp.OptionNames[name]
+	return ok || strings.HasPrefix(name, "option-")
+}
+
 func (c *DhcpgoTool) configureHost(args []string) error {
 	// 00:01:02:03:04:05 ipv4=192.168.1.101,option-67=string:boot-101.pxe
-	return nil
+	// 00:01:02:03:04:05 ipv4=192.168.1.101,bootfile-name=boot-101.pxe
+	// circuit-id=eth1/0/12,remote-id=rack-12 ipv4=192.168.1.112
+	// circuit-id=eth1/0/12,relay=192.168.1.1 ipv4=192.168.1.112
+	if len(args) != 2 {
+		return fmt.Errorf("invalid args %v", args)
+	}
+	host := dhcp.Host{
+		Options: make([]dhcp.Option, 0),
+	}
+	if strings.Contains(args[0], "=") {
+		ids, err := splitParams(args[0])
+		if err != nil {
+			return err
+		}
+		for _, nameVal := range ids {
+			switch nameVal[0] {
+			case "circuit-id":
+				host.CircuitID = nameVal[1]
+			case "remote-id":
+				host.RemoteID = nameVal[1]
+			case "relay":
+				host.Relay = nameVal[1]
+			default:
+				return fmt.Errorf("invalid host id %q", nameVal[0])
+			}
+		}
+	} else {
+		host.MAC = args[0]
+	}
+	params, err := splitParams(args[1])
+	if err != nil {
+		return err
+	}
+	for _, nameVal := range params {
+		switch {
+		case nameVal[0] == "ipv4":
+			if net.ParseIP(nameVal[1]).To4() == nil {
+				return fmt.Errorf("invalid ipv4 %q", nameVal[1])
+			}
+			host.IPv4 = nameVal[1]
+		case isOption(nameVal[0]):
+			opt, err := dhcp.ParseOption(nameVal[0], nameVal[1])
+			if err != nil {
+				return err
+			}
+			host.Options = append(host.Options, opt)
+		default:
+			return fmt.Errorf("invalid args %v", args)
+		}
+	}
+	if host.IPv4 == "" {
+		return fmt.Errorf("ipv4 is required for host %s", args[0])
+	}
+	_, err = dhcp.InitializeHost(&host)
+	if err != nil {
+		return err
+	}
+	return c.client.PutHost(c.ctx, host)
 }
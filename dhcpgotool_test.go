@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/bmcgo/dhcpgo/dhcp"
+)
+
+// fakeClient keeps the configuration put by the tool.
+type fakeClient struct {
+	listens []dhcp.Listen
+	subnets []dhcp.Subnet
+	hosts   []dhcp.Host
+}
+
+func (c *fakeClient) PutListen(ctx context.Context, listen dhcp.Listen) error {
+	c.listens = append(c.listens, listen)
+	return nil
+}
+
+func (c *fakeClient) PutSubnet(ctx context.Context, subnet dhcp.Subnet) error {
+	c.subnets = append(c.subnets, subnet)
+	return nil
+}
+
+func (c *fakeClient) PutHost(ctx context.Context, host dhcp.Host) error {
+	c.hosts = append(c.hosts, host)
+	return nil
+}
+
+func newTestTool() (*DhcpgoTool, *fakeClient) {
+	client := &fakeClient{}
+	return &DhcpgoTool{ctx: context.Background(), client: client}, client
+}
+
+func TestSplitParams(t *testing.T) {
+	for _, tc := range []struct {
+		params string
+		want   [][]string
+		err    bool
+	}{
+		{params: "gw=10.1.1.1", want: [][]string{{"gw", "10.1.1.1"}}},
+		{params: "dns=10.1.1.1,10.2.1.1,gw=10.1.1.1", want: [][]string{{"dns", "10.1.1.1,10.2.1.1"}, {"gw", "10.1.1.1"}}},
+		{params: "option-42=ip-list:10.1.1.1,10.2.1.1", want: [][]string{{"option-42", "ip-list:10.1.1.1,10.2.1.1"}}},
+		{params: "bootfile-name=a=b", want: [][]string{{"bootfile-name", "a=b"}}},
+		{params: "10.1.1.1,gw=10.1.1.1", err: true},
+	} {
+		params, err := splitParams(tc.params)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: no error", tc.params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.params, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.want, params) {
+			t.Errorf("%q: got %v, want %v", tc.params, params, tc.want)
+		}
+	}
+}
+
+func TestConfigureSubnet_Options(t *testing.T) {
+	for _, tc := range []struct {
+		params string
+		want   []dhcp.Option
+		err    bool
+	}{
+		{params: "bootfile-name=boot.pxe", want: []dhcp.Option{{ID: 67, Type: "string", Value: "boot.pxe"}}},
+		{params: "tftp-server-name=10.1.1.5", want: []dhcp.Option{{ID: 66, Type: "string", Value: "10.1.1.5"}}},
+		{params: "ntp-servers=10.1.1.1,10.1.1.2,gw=10.1.1.1", want: []dhcp.Option{{ID: 42, Type: "ip-list", Value: "10.1.1.1,10.1.1.2"}}},
+		{params: "domain-name=example.com", want: []dhcp.Option{{ID: 15, Type: "string", Value: "example.com"}}},
+		{params: "option-67=string:boot.pxe", want: []dhcp.Option{{ID: 67, Type: "string", Value: "boot.pxe"}}},
+		{params: "option-128=uint32:7", want: []dhcp.Option{{ID: 128, Type: "uint32", Value: "7"}}},
+		{params: "option-150=10.1.1.1", want: []dhcp.Option{{ID: 150, Type: "ip-list", Value: "10.1.1.1"}}},
+		{params: "option-254=hex:01:02", want: []dhcp.Option{{ID: 254, Type: "hex", Value: "01:02"}}},
+		{params: "option-255=string:x", err: true},
+		{params: "option-0=string:x", err: true},
+		{params: "option-224=01:02", err: true},
+		{params: "option-128=uint8:256", err: true},
+		{params: "option-200=text:x", err: true},
+		{params: "ntp-servers=example.com", err: true},
+		{params: "ntp-servers=string:x", err: true},
+		{params: "no-such-option=x", err: true},
+	} {
+		tool, client := newTestTool()
+		err := tool.Configure([]string{"subnet", "10.1.1.0/24", "10.1.1.10-10.1.1.99", tc.params})
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: no error", tc.params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.params, err)
+			continue
+		}
+		if len(client.subnets) != 1 || !reflect.DeepEqual(tc.want, client.subnets[0].Options) {
+			t.Errorf("%q: got %v, want %v", tc.params, client.subnets, tc.want)
+		}
+	}
+}
+
+func TestConfigureSubnet_HoldTimes(t *testing.T) {
+	for _, tc := range []struct {
+		params string
+		err    bool
+	}{
+		{params: "offer-hold=30,decline-hold=3600"},
+		{params: "offer-hold=0", err: true},
+		{params: "offer-hold=-1", err: true},
+		{params: "decline-hold=0", err: true},
+		{params: "decline-hold=x", err: true},
+	} {
+		tool, client := newTestTool()
+		err := tool.Configure([]string{"subnet", "10.1.1.0/24", "10.1.1.10-10.1.1.99", tc.params})
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: no error", tc.params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.params, err)
+			continue
+		}
+		if len(client.subnets) != 1 || client.subnets[0].OfferHoldTime != 30 || client.subnets[0].DeclineHoldTime != 3600 {
+			t.Errorf("%q: got %+v", tc.params, client.subnets)
+		}
+	}
+}
+
+func TestConfigureHost(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want dhcp.Host
+		err  bool
+	}{
+		{
+			args: []string{"00:01:02:03:04:05", "ipv4=10.1.1.101,bootfile-name=boot-101.pxe"},
+			want: dhcp.Host{MAC: "00:01:02:03:04:05", IPv4: "10.1.1.101",
+				Options: []dhcp.Option{{ID: 67, Type: "string", Value: "boot-101.pxe"}}},
+		},
+		{
+			args: []string{"00:01:02:03:04:05", "ipv4=10.1.1.101,option-200=uint16:8080"},
+			want: dhcp.Host{MAC: "00:01:02:03:04:05", IPv4: "10.1.1.101",
+				Options: []dhcp.Option{{ID: 200, Type: "uint16", Value: "8080"}}},
+		},
+		{
+			args: []string{"circuit-id=eth1/0/12,remote-id=rack-12", "ipv4=10.1.1.112"},
+			want: dhcp.Host{CircuitID: "eth1/0/12", RemoteID: "rack-12", IPv4: "10.1.1.112", Options: []dhcp.Option{}},
+		},
+		{
+			args: []string{"circuit-id=eth1/0/12,relay=10.1.1.1", "ipv4=10.1.1.112"},
+			want: dhcp.Host{CircuitID: "eth1/0/12", Relay: "10.1.1.1", IPv4: "10.1.1.112", Options: []dhcp.Option{}},
+		},
+		{args: []string{"00:01:02:03:04:05", "ipv4=10.1.1.101,option-200=uint16:x"}, err: true},
+		{args: []string{"00:01:02:03:04:05", "ipv4=10.1.1.101,ntp-servers=x"}, err: true},
+		{args: []string{"00:01:02:03:04:05", "ipv4=10.1.1.101,option-256=string:x"}, err: true},
+		{args: []string{"00:01:02:03:04:05", "bootfile-name=boot.pxe"}, err: true},
+		{args: []string{"circuit-id=eth1/0/12", "ipv4=10.1.1.112"}, err: true},
+		{args: []string{"port=eth1/0/12", "ipv4=10.1.1.112"}, err: true},
+	} {
+		tool, client := newTestTool()
+		err := tool.Configure(append([]string{"host"}, tc.args...))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: no error", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", tc.args, err)
+			continue
+		}
+		if len(client.hosts) != 1 {
+			t.Errorf("%v: got %d hosts", tc.args, len(client.hosts))
+			continue
+		}
+		// the parsed address is not compared
+		host := client.hosts[0]
+		got := dhcp.Host{MAC: host.MAC, CircuitID: host.CircuitID, RemoteID: host.RemoteID, Relay: host.Relay, IPv4: host.IPv4, Options: host.Options}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("%v: got %+v, want %+v", tc.args, got, tc.want)
+		}
+	}
+}
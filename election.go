@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/bmcgo/dhcpgo/dhcp"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// electionTTL is the session TTL in seconds. A standby takes over a subnet
+// this long after its leader stopped refreshing the session.
+const electionTTL = 5
+
+// electionRetry is the delay before retrying a failed session or campaign.
+const electionRetry = time.Second
+
+// ListenHandler starts and stops listeners of the dhcp server.
+type ListenHandler interface {
+	HandleListen(*dhcp.Listen) error
+	StopListen(subnet string)
+}
+
+// electionSession is the etcd session the campaigns of an elector are bound
+// to. Its keys are deleted when it is closed or expires.
+type electionSession interface {
+	Done() <-chan struct{}
+	Close() error
+	// election returns the election for subnet within the session.
+	election(subnet string) election
+}
+
+// election is the etcd election of a subnet owner, see concurrency.Election.
+type election interface {
+	Campaign(ctx context.Context, val string) error
+	Resign(ctx context.Context) error
+}
+
+type etcdSession struct {
+	*concurrency.Session
+	prefix string
+}
+
+func (s etcdSession) election(subnet string) election {
+	return concurrency.NewElection(s.Session, path.Join(s.prefix, subnet))
+}
+
+// campaign is a running election for one subnet.
+type campaign struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	leading bool
+}
+
+// ListenElector starts a listener only at the dhcpgo instance elected as
+// owner of its subnet. Other instances keep the listener closed until the
+// session of the leader expires.
+type ListenElector struct {
+	server ListenHandler
+	name   string
+	// newSession and loadLeases are backed by etcd.
+	newSession func(ctx context.Context) (electionSession, error)
+	loadLeases func(ctx context.Context) error
+
+	mu        sync.Mutex
+	session   electionSession
+	listens   map[string]*dhcp.Listen
+	campaigns map[string]*campaign
+}
+
+func NewListenElector(etcd *EtcdClient, server *dhcp.Server) *ListenElector {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "dhcpgo"
+	}
+	return &ListenElector{
+		server: server,
+		name:   fmt.Sprintf("%s-%d", name, os.Getpid()),
+		newSession: func(ctx context.Context) (electionSession, error) {
+			session, err := concurrency.NewSession(etcd.client, concurrency.WithTTL(electionTTL), concurrency.WithContext(ctx))
+			if err != nil {
+				return nil, err
+			}
+			return etcdSession{Session: session, prefix: etcd.prefixElection}, nil
+		},
+		loadLeases: func(ctx context.Context) error {
+			return etcd.processLeases(ctx, 0, server.HandleLease)
+		},
+		listens:   make(map[string]*dhcp.Listen),
+		campaigns: make(map[string]*campaign),
+	}
+}
+
+// Run keeps the etcd session of the elector alive until ctx is done. When the
+// session expires, all listeners are stopped and the campaigns start over.
+func (e *ListenElector) Run(ctx context.Context) {
+	for {
+		session, err := e.newSession(ctx)
+		if err != nil {
+			log.Printf("failed to create election session: %s", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(electionRetry):
+				continue
+			}
+		}
+		e.mu.Lock()
+		e.session = session
+		for subnet := range e.listens {
+			e.startCampaign(subnet)
+		}
+		e.mu.Unlock()
+
+		select {
+		case <-session.Done():
+			log.Printf("Election session expired")
+		case <-ctx.Done():
+		}
+		e.mu.Lock()
+		campaigns := e.campaigns
+		e.campaigns = make(map[string]*campaign)
+		e.session = nil
+		e.mu.Unlock()
+		for _, c := range campaigns {
+			c.cancel()
+			<-c.done
+		}
+		if ctx.Err() != nil {
+			_ = session.Close()
+			return
+		}
+	}
+}
+
+// HandleListen campaigns for the subnet of listen, or updates the listener
+// if this instance is the leader already.
+func (e *ListenElector) HandleListen(listen *dhcp.Listen) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.listens[listen.Subnet] = listen
+	if c, ok := e.campaigns[listen.Subnet]; ok {
+		if c.leading {
+			return e.server.HandleListen(listen)
+		}
+		return nil
+	}
+	if e.session != nil {
+		e.startCampaign(listen.Subnet)
+	}
+	return nil
+}
+
+// StopListen stops the listener and resigns from the election of subnet.
+func (e *ListenElector) StopListen(subnet string) {
+	e.mu.Lock()
+	c, ok := e.campaigns[subnet]
+	delete(e.listens, subnet)
+	delete(e.campaigns, subnet)
+	e.mu.Unlock()
+	if ok {
+		c.cancel()
+		<-c.done
+	}
+}
+
+// startCampaign must be called with e.mu held and e.session set.
+func (e *ListenElector) startCampaign(subnet string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &campaign{cancel: cancel, done: make(chan struct{})}
+	e.campaigns[subnet] = c
+	go e.campaign(ctx, e.session, subnet, c)
+}
+
+func (e *ListenElector) campaign(ctx context.Context, session electionSession, subnet string, c *campaign) {
+	defer close(c.done)
+	go func() {
+		select {
+		case <-session.Done():
+			c.cancel()
+		case <-ctx.Done():
+		}
+	}()
+	election := session.election(subnet)
+	for {
+		err := election.Campaign(ctx, e.name)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("campaign for %s failed: %s", subnet, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(electionRetry):
+		}
+	}
+	defer func() {
+		select {
+		case <-session.Done():
+			// the key is gone with the session
+			return
+		default:
+		}
+		rctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+		defer cancel()
+		err := election.Resign(rctx)
+		if err != nil {
+			log.Printf("failed to resign from %s: %s", subnet, err)
+		}
+	}()
+	log.Printf("Elected as leader of %s", subnet)
+
+	// the former leader may have changed leases after the watch lagged behind,
+	// otherwise the watched leases are used
+	err := e.loadLeases(ctx)
+	if err != nil {
+		log.Printf("failed to reload leases for %s: %s", subnet, err)
+	}
+	e.mu.Lock()
+	listen, ok := e.listens[subnet]
+	if ok && ctx.Err() == nil {
+		c.leading = true
+		err = e.server.HandleListen(listen)
+	}
+	e.mu.Unlock()
+	if !c.leading {
+		return
+	}
+	if err != nil {
+		log.Printf("failed to listen on %s: %s", subnet, err)
+	}
+	<-ctx.Done()
+	log.Printf("Stepping down as leader of %s", subnet)
+	e.server.StopListen(subnet)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmcgo/dhcpgo/dhcp"
+)
+
+// fakeElections keeps the leaders of subnet elections like the election
+// prefix in etcd: campaigners lead in the order they campaigned, each until
+// it resigns or its session expires.
+type fakeElections struct {
+	mu      sync.Mutex
+	leaders map[string]*fakeSession
+	waiting map[string][]*fakeSession
+}
+
+func (f *fakeElections) newSession(ctx context.Context) (electionSession, error) {
+	return &fakeSession{elections: f, done: make(chan struct{})}, nil
+}
+
+// leader returns the session leading subnet, or nil.
+func (f *fakeElections) leader(subnet string) *fakeSession {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.leaders[subnet]
+	if s == nil || s.expired() {
+		return nil
+	}
+	return s
+}
+
+type fakeSession struct {
+	elections *fakeElections
+	once      sync.Once
+	done      chan struct{}
+}
+
+func (s *fakeSession) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *fakeSession) Close() error {
+	s.expire()
+	return nil
+}
+
+func (s *fakeSession) expire() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func (s *fakeSession) expired() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *fakeSession) election(subnet string) election {
+	return &fakeElection{session: s, subnet: subnet}
+}
+
+type fakeElection struct {
+	session *fakeSession
+	subnet  string
+}
+
+func (e *fakeElection) Campaign(ctx context.Context, val string) error {
+	f := e.session.elections
+	f.mu.Lock()
+	f.waiting[e.subnet] = append(f.waiting[e.subnet], e.session)
+	f.mu.Unlock()
+	defer e.leave()
+	for {
+		f.mu.Lock()
+		if e.session.expired() {
+			f.mu.Unlock()
+			return fmt.Errorf("session expired")
+		}
+		leader := f.leaders[e.subnet]
+		if (leader == nil || leader.expired()) && e.first() {
+			f.leaders[e.subnet] = e.session
+			f.mu.Unlock()
+			return nil
+		}
+		f.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+// first reports whether the session waits longest among live campaigners.
+// It must be called with the elections locked.
+func (e *fakeElection) first() bool {
+	for _, s := range e.session.elections.waiting[e.subnet] {
+		if !s.expired() {
+			return s == e.session
+		}
+	}
+	return false
+}
+
+// leave removes the session from the campaigners.
+func (e *fakeElection) leave() {
+	f := e.session.elections
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	waiting := f.waiting[e.subnet]
+	for i, s := range waiting {
+		if s == e.session {
+			f.waiting[e.subnet] = append(waiting[:i:i], waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+func (e *fakeElection) Resign(ctx context.Context) error {
+	f := e.session.elections
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.leaders[e.subnet] == e.session {
+		delete(f.leaders, e.subnet)
+	}
+	return nil
+}
+
+// fakeListens records the calls of an elector to its server.
+type fakeListens struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (f *fakeListens) record(event string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+}
+
+func (f *fakeListens) HandleListen(listen *dhcp.Listen) error {
+	f.record("listen " + listen.Subnet)
+	return nil
+}
+
+func (f *fakeListens) StopListen(subnet string) {
+	f.record("stop " + subnet)
+}
+
+// last returns the last event, or "".
+func (f *fakeListens) last() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.events) == 0 {
+		return ""
+	}
+	return f.events[len(f.events)-1]
+}
+
+func (f *fakeListens) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fmt.Sprint(f.events)
+}
+
+func (f *fakeListens) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.events)
+}
+
+func newTestElector(elections *fakeElections, name string) (*ListenElector, *fakeListens) {
+	listens := &fakeListens{}
+	e := &ListenElector{
+		server:     listens,
+		name:       name,
+		newSession: elections.newSession,
+		loadLeases: func(ctx context.Context) error {
+			listens.record("leases")
+			return nil
+		},
+		listens:   make(map[string]*dhcp.Listen),
+		campaigns: make(map[string]*campaign),
+	}
+	return e, listens
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestListenElector(t *testing.T) {
+	const subnet = "10.1.1.0/24"
+	elections := &fakeElections{
+		leaders: make(map[string]*fakeSession),
+		waiting: make(map[string][]*fakeSession),
+	}
+	e1, listens1 := newTestElector(elections, "dhcpgo-1")
+	e2, listens2 := newTestElector(elections, "dhcpgo-2")
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, e := range []*ListenElector{e1, e2} {
+		wg.Add(1)
+		go func(e *ListenElector) {
+			defer wg.Done()
+			e.Run(ctx)
+		}(e)
+	}
+	listen := &dhcp.Listen{Interface: "eth0", Subnet: subnet, Laddr: "10.1.1.1"}
+
+	// the first instance is elected, reloads the leases and starts listening
+	if err := e1.HandleListen(listen); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "leader", func() bool { return listens1.last() == "listen "+subnet })
+	if events := listens1.String(); events != "[leases listen "+subnet+"]" {
+		t.Fatalf("unexpected events of the leader: %s", events)
+	}
+	if err := e2.HandleListen(listen); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if listens2.count() != 0 {
+		t.Fatalf("standby started listening: %v", listens2)
+	}
+
+	// the standby takes over when the session of the leader expires
+	leader := elections.leader(subnet)
+	if leader == nil {
+		t.Fatal("no leader")
+	}
+	leader.expire()
+	waitFor(t, "step down", func() bool { return listens1.last() == "stop "+subnet })
+	waitFor(t, "takeover", func() bool { return listens2.last() == "listen "+subnet })
+	if events := listens2.String(); events != "[leases listen "+subnet+"]" {
+		t.Fatalf("unexpected events of the new leader: %s", events)
+	}
+
+	// the former leader campaigns again in a new session and stays standby
+	time.Sleep(time.Millisecond * 50)
+	if listens1.last() != "stop "+subnet {
+		t.Fatalf("former leader listens again: %v", listens1)
+	}
+
+	// removed listen stops the leader, which resigns for the standby
+	e2.StopListen(subnet)
+	if listens2.last() != "stop "+subnet {
+		t.Fatalf("leader did not stop: %v", listens2)
+	}
+	waitFor(t, "resign", func() bool { return listens1.last() == "listen "+subnet })
+
+	cancel()
+	wg.Wait()
+	if listens1.last() != "stop "+subnet {
+		t.Fatalf("listener is not stopped on exit: %v", listens1)
+	}
+}
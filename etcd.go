@@ -3,17 +3,30 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	"go.etcd.io/etcd/client/pkg/v3/transport"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"log"
 	"net"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bmcgo/dhcpgo/dhcp"
 )
 
+const etcdRequestTimeout = time.Second * 5
+
+// claimAttempts limits retries of a lease update racing with other servers.
+const claimAttempts = 3
+
+// grantPeriod rounds up the expiry of stored leases, so the keys expiring in
+// the same period share one etcd lease instead of granting one per claim.
+const grantPeriod = time.Second * 10
+
 type EtcdClientConfig struct {
 	endpoints  []string
 	caCertPath string
@@ -28,7 +41,17 @@ type EtcdClient struct {
 	prefix             string
 	prefixConfigSubnet string
 	prefixConfigListen string
+	prefixConfigHost   string
 	prefixLeases       string
+	prefixElection     string
+
+	mu sync.Mutex
+	// readyErr is why the config is not loaded or watched.
+	readyErr error
+
+	grantMu sync.Mutex
+	// grants are the etcd leases by the end of their grantPeriod.
+	grants map[int64]clientv3.LeaseID
 }
 
 func NewEtcdClient(ctx context.Context, c *EtcdClientConfig, timeout time.Duration) (*EtcdClient, error) {
@@ -38,6 +61,11 @@ func NewEtcdClient(ctx context.Context, c *EtcdClientConfig, timeout time.Durati
 		prefix:             prefix,
 		prefixConfigSubnet: path.Join(prefix, "subnet"),
 		prefixConfigListen: path.Join(prefix, "listen"),
+		prefixConfigHost:   path.Join(prefix, "host"),
+		prefixLeases:       path.Join(prefix, "lease"),
+		prefixElection:     path.Join(prefix, "election"),
+		readyErr:           errors.New("config is not loaded"),
+		grants:             make(map[int64]clientv3.LeaseID),
 	}
 	tlsInfo := transport.TLSInfo{
 		CertFile:      c.certPath,
@@ -64,8 +92,27 @@ func NewEtcdClient(ctx context.Context, c *EtcdClientConfig, timeout time.Durati
 	return client, client.client.Sync(ct)
 }
 
-func (c *EtcdClient) processListens(ctx context.Context, handler func(*dhcp.Listen) error) error {
-	resp, err := c.client.Get(ctx, c.prefixConfigListen, clientv3.WithPrefix())
+// revision returns the current revision of the store.
+func (c *EtcdClient) revision(ctx context.Context) (int64, error) {
+	resp, err := c.client.Get(ctx, c.prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get revision: %s", err)
+	}
+	return resp.Header.Revision, nil
+}
+
+// list returns the keys under prefix at rev, or at the current revision if
+// rev is 0.
+func (c *EtcdClient) list(ctx context.Context, prefix string, rev int64) (*clientv3.GetResponse, error) {
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+	return c.client.Get(ctx, prefix, opts...)
+}
+
+func (c *EtcdClient) processListens(ctx context.Context, rev int64, handler func(*dhcp.Listen) error) error {
+	resp, err := c.list(ctx, c.prefixConfigListen, rev)
 	if err != nil {
 		return fmt.Errorf("failed to list config prefix: %s", err)
 	}
@@ -84,8 +131,8 @@ func (c *EtcdClient) processListens(ctx context.Context, handler func(*dhcp.List
 	return nil
 }
 
-func (c *EtcdClient) processSubnets(ctx context.Context, handler func(*dhcp.Subnet) error) error {
-	resp, err := c.client.Get(ctx, c.prefixConfigSubnet, clientv3.WithPrefix())
+func (c *EtcdClient) processSubnets(ctx context.Context, rev int64, handler func(*dhcp.Subnet) error) error {
+	resp, err := c.list(ctx, c.prefixConfigSubnet, rev)
 	if err != nil {
 		return fmt.Errorf("failed to list config prefix: %s", err)
 	}
@@ -108,31 +155,180 @@ func (c *EtcdClient) processSubnets(ctx context.Context, handler func(*dhcp.Subn
 	return nil
 }
 
-func (c *EtcdClient) WatchConfig(ctx context.Context, server *dhcp.Server) {
-	var err error
+func (c *EtcdClient) processHosts(ctx context.Context, rev int64, handler func(*dhcp.Host) error) error {
+	resp, err := c.list(ctx, c.prefixConfigHost, rev)
+	if err != nil {
+		return fmt.Errorf("failed to list config prefix: %s", err)
+	}
+	for _, kv := range resp.Kvs {
+		h := &dhcp.Host{}
+		err = json.Unmarshal(kv.Value, h)
+		if err != nil {
+			log.Printf("failed to unmarshal host %q", kv.Key)
+		} else {
+			err = handler(h)
+			if err != nil {
+				log.Printf("error handling host %q, %s", kv.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *EtcdClient) processLeases(ctx context.Context, rev int64, handler func(*dhcp.Lease) error) error {
+	resp, err := c.list(ctx, c.prefixLeases, rev)
+	if err != nil {
+		return fmt.Errorf("failed to list leases prefix: %s", err)
+	}
+	for _, kv := range resp.Kvs {
+		l := &dhcp.Lease{}
+		err = json.Unmarshal(kv.Value, l)
+		if err != nil {
+			log.Printf("failed to unmarshal lease %q", kv.Key)
+		} else {
+			err = handler(l)
+			if err != nil {
+				log.Printf("error handling lease %q, %s", kv.Key, err)
+			}
+		}
+	}
+	log.Printf("Loaded %d leases", len(resp.Kvs))
+	return nil
+}
+
+// WatchConfig applies the config to server. Listeners are started and stopped
+// by listens, which is the server itself or a ListenElector.
+func (c *EtcdClient) WatchConfig(ctx context.Context, server *dhcp.Server, listens ListenHandler) {
+	var err, loadErr error
 	log.Printf("Watching config with prefix: %s", c.prefix)
-	err = c.processListens(ctx, server.HandleListen)
+	// everything is loaded at one revision and the changes after it are watched
+	rev, err := c.revision(ctx)
+	if err != nil {
+		log.Println(err)
+		loadErr = err
+	}
+	err = c.processSubnets(ctx, rev, server.HandleSubnet)
+	if err != nil {
+		log.Println(err)
+		loadErr = err
+	}
+	err = c.processHosts(ctx, rev, server.HandleHost)
 	if err != nil {
 		log.Println(err)
+		loadErr = err
 	}
-	err = c.processSubnets(ctx, server.HandleSubnet)
+	// leases must be in place before listeners start answering
+	err = c.processLeases(ctx, rev, server.HandleLease)
 	if err != nil {
 		log.Println(err)
+		loadErr = err
 	}
-	ch := c.client.Watch(ctx, c.prefixConfigSubnet, clientv3.WithPrefix())
+	err = c.processListens(ctx, rev, listens.HandleListen)
+	if err != nil {
+		log.Println(err)
+		loadErr = err
+	}
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev+1))
+	}
+	ch := c.client.Watch(ctx, c.prefix, opts...)
+	c.setReady(loadErr)
 	for {
 		resp, ok := <-ch
 		for _, ev := range resp.Events {
-			log.Println(ev)
-			//TODO: update config
+			err = c.handleConfigEvent(server, listens, ev)
+			if err != nil {
+				log.Printf("error handling %s %q: %s", ev.Type, ev.Kv.Key, err)
+			}
 		}
 		if !ok {
 			log.Println("Config watcher stopped")
+			c.setReady(errors.New("config watcher stopped"))
 			return
 		}
 	}
 }
 
+func (c *EtcdClient) setReady(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readyErr = err
+}
+
+// Ready returns an error unless the config is loaded and watched.
+func (c *EtcdClient) Ready() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readyErr
+}
+
+// keyName returns the part of key after prefix, which is the subnet for
+// listen and subnet keys.
+func keyName(prefix string, key string) (string, bool) {
+	if key == prefix {
+		return "", true
+	}
+	if strings.HasPrefix(key, prefix+"/") {
+		return key[len(prefix)+1:], true
+	}
+	return "", false
+}
+
+func (c *EtcdClient) handleConfigEvent(server *dhcp.Server, listens ListenHandler, ev *clientv3.Event) error {
+	key := string(ev.Kv.Key)
+	if name, ok := keyName(c.prefixConfigSubnet, key); ok {
+		if ev.Type == clientv3.EventTypeDelete {
+			server.RemoveSubnet(name)
+			return nil
+		}
+		s := &dhcp.Subnet{}
+		err := json.Unmarshal(ev.Kv.Value, s)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal subnet: %s", err)
+		}
+		return server.HandleSubnet(s)
+	}
+	if name, ok := keyName(c.prefixConfigListen, key); ok {
+		if ev.Type == clientv3.EventTypeDelete {
+			listens.StopListen(name)
+			return nil
+		}
+		l := &dhcp.Listen{}
+		err := json.Unmarshal(ev.Kv.Value, l)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal listener: %s", err)
+		}
+		return listens.HandleListen(l)
+	}
+	if name, ok := keyName(c.prefixConfigHost, key); ok {
+		if ev.Type == clientv3.EventTypeDelete {
+			server.RemoveHost(name)
+			return nil
+		}
+		h := &dhcp.Host{}
+		err := json.Unmarshal(ev.Kv.Value, h)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal host: %s", err)
+		}
+		return server.HandleHost(h)
+	}
+	if _, ok := keyName(c.prefixLeases, key); ok {
+		// leases of other servers and our own, which are already in place
+		if ev.Type == clientv3.EventTypeDelete {
+			server.RemoveLease(path.Base(key))
+			return nil
+		}
+		l := &dhcp.Lease{}
+		err := json.Unmarshal(ev.Kv.Value, l)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal lease: %s", err)
+		}
+		return server.HandleLease(l)
+	}
+	return nil
+}
+
 func (c *EtcdClient) GetLease(mac net.HardwareAddr) *dhcp.Lease {
 	lease, ok := c.leases[mac.String()]
 	if ok {
@@ -176,3 +372,172 @@ func (c *EtcdClient) PutSubnet(ctx context.Context, sn dhcp.Subnet) error {
 	}
 	return err
 }
+
+// leaseKey returns the key of the lease, which is named by the address, so
+// an address is held by one client at a time across all servers.
+func (c *EtcdClient) leaseKey(lease *dhcp.Lease) string {
+	return path.Join(c.prefixLeases, lease.Subnet, lease.IP)
+}
+
+// sameClient reports whether both leases are of the same client.
+func sameClient(a *dhcp.Lease, b *dhcp.Lease) bool {
+	return a.MAC == b.MAC && a.ClientID == b.ClientID
+}
+
+// getHolder returns the lease stored in kv, or nil if kv is not set.
+func getHolder(kv *mvccpb.KeyValue) (*dhcp.Lease, error) {
+	if kv == nil {
+		return nil, nil
+	}
+	holder := &dhcp.Lease{}
+	err := json.Unmarshal(kv.Value, holder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lease %q: %s", kv.Key, err)
+	}
+	return holder, nil
+}
+
+// HandleLease persists a lease changed by the dhcp server. Bound and declined
+// leases are stored with etcd lease TTL, so they disappear when expired.
+func (c *EtcdClient) HandleLease(lease *dhcp.Lease) error {
+	switch lease.State {
+	case dhcp.LeaseStateReleased, dhcp.LeaseStateExpired:
+		return c.deleteLease(lease)
+	case dhcp.LeaseStateOffered:
+		return nil
+	}
+	return c.ClaimLease(lease, lease.LastUpdate.Add(time.Second*time.Duration(lease.LeaseTime)))
+}
+
+// ClaimLease stores lease until expiry, unless its address is held by a
+// client of another server. The key is created only if it does not exist, or
+// updated if it was not changed since it was read, so concurrent servers
+// cannot give the address to different clients.
+func (c *EtcdClient) ClaimLease(lease *dhcp.Lease, expiry time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+	p := c.leaseKey(lease)
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	if time.Until(expiry) < time.Second {
+		return fmt.Errorf("lease %s is already expired", p)
+	}
+	leaseID, err := c.grant(ctx, expiry)
+	if err != nil {
+		return fmt.Errorf("failed to grant etcd lease for %s: %s", p, err)
+	}
+	put := clientv3.OpPut(p, string(data), clientv3.WithLease(leaseID))
+	cmp := clientv3.Compare(clientv3.CreateRevision(p), "=", 0)
+	for i := 0; i < claimAttempts; i++ {
+		resp, err := c.client.Txn(ctx).If(cmp).Then(put).Else(clientv3.OpGet(p)).Commit()
+		if err != nil {
+			// the etcd lease may be gone, the next claim grants another one
+			c.forgetGrant(leaseID)
+			return fmt.Errorf("failed to put lease %s: %s", p, err)
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		var kv *mvccpb.KeyValue
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			kv = kvs[0]
+		}
+		holder, err := getHolder(kv)
+		if err != nil {
+			return err
+		}
+		if holder == nil {
+			// deleted meanwhile
+			cmp = clientv3.Compare(clientv3.CreateRevision(p), "=", 0)
+			continue
+		}
+		if !sameClient(holder, lease) {
+			return fmt.Errorf("%w: %s is held by %s", dhcp.ErrLeaseTaken, lease.IP, holder.MAC)
+		}
+		cmp = clientv3.Compare(clientv3.ModRevision(p), "=", kv.ModRevision)
+	}
+	return fmt.Errorf("failed to put lease %s: too many concurrent updates", p)
+}
+
+// grant returns the etcd lease expiring at the end of the grantPeriod of
+// expiry. The lease is shared by all keys claimed until the same period, so
+// it is never revoked; it expires together with the keys.
+func (c *EtcdClient) grant(ctx context.Context, expiry time.Time) (clientv3.LeaseID, error) {
+	end := expiry.Truncate(grantPeriod).Add(grantPeriod)
+	c.grantMu.Lock()
+	defer c.grantMu.Unlock()
+	if id, ok := c.grants[end.Unix()]; ok {
+		return id, nil
+	}
+	grant, err := c.client.Grant(ctx, int64(time.Until(end)/time.Second)+1)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	for t := range c.grants {
+		if t <= now {
+			delete(c.grants, t)
+		}
+	}
+	c.grants[end.Unix()] = grant.ID
+	return grant.ID, nil
+}
+
+func (c *EtcdClient) forgetGrant(id clientv3.LeaseID) {
+	c.grantMu.Lock()
+	defer c.grantMu.Unlock()
+	for t, grantID := range c.grants {
+		if grantID == id {
+			delete(c.grants, t)
+		}
+	}
+}
+
+// deleteLease removes the lease unless its address is held by another client by now.
+func (c *EtcdClient) deleteLease(lease *dhcp.Lease) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+	p := c.leaseKey(lease)
+	for i := 0; i < claimAttempts; i++ {
+		resp, err := c.client.Get(ctx, p)
+		if err != nil {
+			return fmt.Errorf("failed to get lease %s: %s", p, err)
+		}
+		if len(resp.Kvs) == 0 {
+			return nil
+		}
+		holder, err := getHolder(resp.Kvs[0])
+		if err != nil {
+			return err
+		}
+		if !sameClient(holder, lease) {
+			return nil
+		}
+		txn, err := c.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(p), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpDelete(p)).
+			Commit()
+		if err != nil {
+			return fmt.Errorf("failed to delete lease %s: %s", p, err)
+		}
+		if txn.Succeeded {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to delete lease %s: too many concurrent updates", p)
+}
+
+func (c *EtcdClient) PutHost(ctx context.Context, h dhcp.Host) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	p := path.Join(c.prefixConfigHost, h.Key())
+	resp, err := c.client.Put(ctx, p, string(data))
+	if err != nil {
+		log.Printf("failed to put host:%s : %v", err, resp)
+	}
+	return err
+}
@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/google/gopacket v1.1.19
 	github.com/insomniacslk/dhcp v0.0.0-20220405050111-12fbdcb11b41
+	go.etcd.io/etcd/api/v3 v3.5.3
 	go.etcd.io/etcd/client/pkg/v3 v3.5.3
 	go.etcd.io/etcd/client/v3 v3.5.3
 )
@@ -15,7 +16,6 @@ require (
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/u-root/uio v0.0.0-20210528114334-82958018845c // indirect
-	go.etcd.io/etcd/api/v3 v3.5.3 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.17.0 // indirect
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/bmcgo/dhcpgo/dhcp"
+)
+
+const defaultHealthAddr = ":8080"
+
+// serveHealth serves the endpoints for k8s probes at addr. It returns an
+// error if addr cannot be listened on, the DHCP server keeps running if the
+// endpoints stop later.
+func serveHealth(addr string, server *dhcp.Server, etcd *EtcdClient) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := http.Serve(l, healthMux(server, etcd.Ready))
+		log.Printf("health endpoints stopped: %s", err)
+	}()
+	return nil
+}
+
+// healthMux returns the endpoints: /healthz while the process is alive,
+// /livez until a listener exits unexpectedly, and /readyz once the config is
+// loaded and all listeners are serving.
+func healthMux(server *dhcp.Server, configReady func() error) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler(func() error { return nil }))
+	mux.HandleFunc("/livez", healthHandler(server.Live))
+	mux.HandleFunc("/readyz", healthHandler(func() error {
+		err := configReady()
+		if err != nil {
+			return err
+		}
+		return server.Ready()
+	}))
+	return mux
+}
+
+func healthHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := check()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
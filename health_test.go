@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/bmcgo/dhcpgo/dhcp"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+)
+
+// fakeDHCPServer serves until the error sent to exit, which Close sends nil to.
+type fakeDHCPServer struct {
+	exit chan error
+}
+
+func (f *fakeDHCPServer) Serve() error {
+	return <-f.exit
+}
+
+func (f *fakeDHCPServer) Close() error {
+	select {
+	case f.exit <- nil:
+	default:
+	}
+	return nil
+}
+
+func (f *fakeDHCPServer) NewServer(listenInterface string, listenAddress string, handler server4.Handler) (dhcp.DHCPv4Server, error) {
+	return f, nil
+}
+
+type fakeResponder struct{}
+
+func (r fakeResponder) Close() {}
+
+func (r fakeResponder) SendUnicast(resp *dhcpv4.DHCPv4, peer net.Addr) error {
+	return nil
+}
+
+func (r fakeResponder) SendBroadcast(resp *dhcpv4.DHCPv4) error {
+	return nil
+}
+
+func (r fakeResponder) SendHardwareUnicast(resp *dhcpv4.DHCPv4) error {
+	return nil
+}
+
+func (r fakeResponder) NewResponder(listen *dhcp.Listen) (dhcp.Responder, error) {
+	return r, nil
+}
+
+func TestHealthMux(t *testing.T) {
+	fs := &fakeDHCPServer{exit: make(chan error, 1)}
+	server := dhcp.NewServer(dhcp.ServerConfig{DHCPv4ServerFactory: fs, ResponderFactory: fakeResponder{}})
+	var (
+		mu        sync.Mutex
+		configErr = errors.New("config is not loaded")
+	)
+	ts := httptest.NewServer(healthMux(server, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return configErr
+	}))
+	defer ts.Close()
+	status := func(path string) int {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz: %d", code)
+	}
+	if code := status("/livez"); code != http.StatusOK {
+		t.Errorf("/livez: %d", code)
+	}
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before config: %d", code)
+	}
+
+	mu.Lock()
+	configErr = nil
+	mu.Unlock()
+	err := server.HandleListen(&dhcp.Listen{Interface: "eth0", Subnet: "10.1.1.0/24", Laddr: "10.1.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "ready", func() bool { return status("/readyz") == http.StatusOK })
+
+	// the listener exits unexpectedly
+	fs.exit <- errors.New("interface is down")
+	waitFor(t, "not live", func() bool { return status("/livez") == http.StatusServiceUnavailable })
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after exit: %d", code)
+	}
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz after exit: %d", code)
+	}
+}
+
+func TestServeHealth_AddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := dhcp.NewServer(dhcp.ServerConfig{})
+	if serveHealth(l.Addr().String(), server, &EtcdClient{}) == nil {
+		t.Error("no error for the address in use")
+	}
+}
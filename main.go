@@ -2,13 +2,24 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/bmcgo/dhcpgo/dhcp"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// High availability modes, selected by DHCPGO_HA_MODE.
+const (
+	// haModeActiveActive serves every subnet by all instances, which claim
+	// addresses in etcd before offering them.
+	haModeActiveActive = "active-active"
+	// haModeActivePassive serves every subnet by one instance elected in etcd.
+	haModeActivePassive = "active-passive"
+)
+
 func getenv(key string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -17,6 +28,38 @@ func getenv(key string) string {
 	return value
 }
 
+// startFailover starts the failover relationship with a peer server, which
+// is configured by DHCPGO_FAILOVER_* variables.
+func startFailover(server *dhcp.Server, role string) error {
+	config := dhcp.FailoverConfig{
+		Name:  getenv("DHCPGO_FAILOVER_NAME"),
+		Role:  role,
+		Laddr: os.Getenv("DHCPGO_FAILOVER_LADDR"),
+		Peer:  os.Getenv("DHCPGO_FAILOVER_PEER"),
+	}
+	var err error
+	for _, v := range []struct {
+		key   string
+		value *int
+	}{
+		{"DHCPGO_FAILOVER_SPLIT", &config.Split},
+		{"DHCPGO_FAILOVER_MCLT", &config.MCLT},
+		{"DHCPGO_FAILOVER_AUTO_PARTNER_DOWN", &config.AutoPartnerDown},
+	} {
+		if s := os.Getenv(v.key); s != "" {
+			*v.value, err = strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", v.key, err)
+			}
+		}
+	}
+	failover, err := dhcp.NewFailover(server, config)
+	if err != nil {
+		return err
+	}
+	return failover.Start()
+}
+
 func main() {
 	var (
 		config    EtcdClientConfig
@@ -55,12 +98,39 @@ func main() {
 		return
 	}
 
-	server := dhcp.NewServer(dhcp.GetDefaultServerConfig(HandleLease))
-	etcd.WatchConfig(context.Background(), server)
+	var (
+		server  *dhcp.Server
+		listens ListenHandler
+	)
+	serverConfig := dhcp.GetDefaultServerConfig(etcd.HandleLease)
+	switch mode := os.Getenv("DHCPGO_HA_MODE"); mode {
+	case "", haModeActiveActive:
+		serverConfig.ClaimLease = etcd.ClaimLease
+		server = dhcp.NewServer(serverConfig)
+		listens = server
+	case haModeActivePassive:
+		server = dhcp.NewServer(serverConfig)
+		elector := NewListenElector(etcd, server)
+		go elector.Run(context.Background())
+		listens = elector
+	default:
+		log.Fatalf("unknown DHCPGO_HA_MODE %q", mode)
+	}
+	if role := os.Getenv("DHCPGO_FAILOVER_ROLE"); role != "" {
+		err = startFailover(server, role)
+		if err != nil {
+			log.Fatalf("unable to start failover: %s", err)
+		}
+	}
+	healthAddr := os.Getenv("DHCPGO_HEALTH_ADDR")
+	if healthAddr == "" {
+		healthAddr = defaultHealthAddr
+	}
+	err = serveHealth(healthAddr, server, etcd)
+	if err != nil {
+		// probes fail without the endpoints, the clients are served anyway
+		log.Printf("unable to serve health endpoints: %s", err)
+	}
+	etcd.WatchConfig(context.Background(), server, listens)
 	log.Printf("Exited")
 }
-
-func HandleLease(lease *dhcp.Lease) error {
-	//TODO: etcd
-	return nil
-}
\ No newline at end of file